@@ -16,7 +16,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"runtime"
@@ -31,10 +31,14 @@ import (
 	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
+
+	"github.com/anguslees/aws-cni-plugins/internal/logging"
 )
 
 var version string
 
+const pluginName = "egress-v4"
+
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
@@ -45,6 +49,7 @@ func init() {
 // NetConf is our CNI config structure
 type NetConf struct {
 	types.NetConf
+	logging.Conf
 
 	// Interface inside container to create
 	IfName string `json:"ifName"`
@@ -70,6 +75,11 @@ func loadConf(bytes []byte) (*NetConf, error) {
 			return nil, fmt.Errorf("could not parse prevResult: %v", err)
 		}
 	}
+
+	if _, err := n.Conf.Level(); err != nil {
+		return nil, err
+	}
+
 	return n, nil
 }
 
@@ -241,11 +251,9 @@ func setupHostVeth(vethName string, result *cniv1.Result) error {
 }
 
 func main() {
-	log.SetFlags(log.Ltime | log.Lshortfile)
-	log.SetPrefix("CNI egress-v4: ")
-	log.SetOutput(os.Stderr) // NB: ends up in kubelet syslog
+	logging.Init(pluginName)
 
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, cniversion.All, fmt.Sprintf("egress-v4 CNI plugin %s", version))
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, cniversion.All, fmt.Sprintf("%s CNI plugin %s", pluginName, version))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -254,6 +262,14 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
+	done, err := logging.Setup(pluginName, netConf.Conf, "CHECK", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	slog.Debug("CHECK", "config", string(args.StdinData))
+
 	if netConf.PrevResult == nil {
 		return fmt.Errorf("must be called as a chained plugin")
 	}
@@ -285,7 +301,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
-	//log.Printf("doing ADD: conf=%v", netConf)
+	done, err := logging.Setup(pluginName, netConf.Conf, "ADD", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	slog.Debug("ADD", "config", string(args.StdinData))
 
 	if netConf.PrevResult == nil {
 		return fmt.Errorf("must be called as a chained plugin")
@@ -348,12 +370,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	//log.Printf("Set up host iface %q. Result: %v", hostInterface.Name, tmpResult)
+	slog.Debug("Set up host iface", "iface", hostInterface.Name, "result", tmpResult)
 
 	if netConf.SnatIP != nil {
 		for _, ipc := range tmpResult.IPs {
 			if ipc.Address.IP.To4() != nil {
-				//log.Printf("Configuring SNAT %s -> %s", ipc.Address.IP, netConf.SnatIP)
+				slog.Debug("Configuring SNAT", "src", ipc.Address.IP, "snatIP", netConf.SnatIP)
 				if err := snat4(netConf.SnatIP, ipc.Address.IP, chain, comment); err != nil {
 					return err
 				}
@@ -364,7 +386,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// Copy interfaces over to result, but not IPs.
 	result.Interfaces = append(result.Interfaces, tmpResult.Interfaces...)
 
-	//log.Printf("Returning result: %v", result)
+	slog.Debug("ADD returning", "result", result)
 
 	// Pass through the previous result
 	return types.PrintResult(result, netConf.CNIVersion)
@@ -376,6 +398,14 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
+	done, err := logging.Setup(pluginName, netConf.Conf, "DEL", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	slog.Debug("DEL", "config", string(args.StdinData))
+
 	if err := ipam.ExecDel(netConf.IPAM.Type, args.StdinData); err != nil {
 		return fmt.Errorf("running IPAM plugin failed: %v", err)
 	}
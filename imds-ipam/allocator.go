@@ -27,15 +27,31 @@ import (
 type IMDSAllocator struct {
 	store  *Store
 	client metadata.TypedIMDS
+
+	// Network cards to allocate from.  Empty means all cards.
+	networkCards []int
 }
 
-func NewIMDSAllocator(imds metadata.EC2MetadataIface, store *Store) *IMDSAllocator {
+func NewIMDSAllocator(imds metadata.EC2MetadataIface, store *Store, networkCards []int) *IMDSAllocator {
 	return &IMDSAllocator{
-		store:  store,
-		client: metadata.NewTypedIMDS(imds),
+		store:        store,
+		client:       metadata.NewTypedIMDS(imds),
+		networkCards: networkCards,
 	}
 }
 
+func (a *IMDSAllocator) allowedCard(card int) bool {
+	if len(a.networkCards) == 0 {
+		return true
+	}
+	for _, c := range a.networkCards {
+		if c == card {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *IMDSAllocator) Get(ctx context.Context, id, ifname, version string) (cniv1.IPConfig, error) {
 	macs, err := a.client.GetMACs(ctx)
 	if err != nil {
@@ -53,11 +69,23 @@ func (a *IMDSAllocator) Get(ctx context.Context, id, ifname, version string) (cn
 	for _, mac := range macs {
 		// TODO: skip interface if ignored
 
+		card, err := a.client.GetNetworkCard(ctx, mac)
+		if err != nil {
+			return cniv1.IPConfig{}, err
+		}
+		if !a.allowedCard(card) {
+			continue
+		}
+
 		var gw net.IP
 		var ips []net.IP
 		var subnet net.IPNet
 		if version == "4" {
 			ips, err = a.client.GetLocalIPv4s(ctx, mac)
+			if metadata.IsNotFound(err) {
+				// IPv6-only ENI
+				continue
+			}
 			if err != nil {
 				return cniv1.IPConfig{}, err
 			}
@@ -75,6 +103,10 @@ func (a *IMDSAllocator) Get(ctx context.Context, id, ifname, version string) (cn
 			}
 
 			subnet, err = a.client.GetSubnetIPv6CIDRBlocks(ctx, mac)
+			if metadata.IsNotFound(err) {
+				// IPv4-only ENI
+				continue
+			}
 			if err != nil {
 				return cniv1.IPConfig{}, err
 			}
@@ -82,6 +114,9 @@ func (a *IMDSAllocator) Get(ctx context.Context, id, ifname, version string) (cn
 			gw = net.IP{0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1} // fe80::1
 		}
 
+		if len(ips) == 0 {
+			continue
+		}
 		// Reserve ip[0] (primary IP) on each ENI for host
 		ips = ips[1:]
 
@@ -90,7 +125,7 @@ func (a *IMDSAllocator) Get(ctx context.Context, id, ifname, version string) (cn
 		})
 
 		for _, ip := range ips {
-			switch err := a.store.ReserveIP(id, ifname, ip); err {
+			switch err := a.store.ReserveIP(id, ifname, ip, card); err {
 			case nil:
 				result := cniv1.IPConfig{
 					Address: net.IPNet{IP: ip, Mask: subnet.Mask},
@@ -0,0 +1,56 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+func TestAllocatorMixedFamilies(t *testing.T) {
+	const (
+		v4MAC = "02:00:00:00:00:01"
+		v6MAC = "02:00:00:00:00:02"
+	)
+	// Single-family ENIs only: whichever comes first, the other
+	// family must skip it
+	imds := metadata.FakeIMDS(map[string]interface{}{
+		"network/interfaces/macs": v4MAC + "/\n" + v6MAC + "/",
+
+		"network/interfaces/macs/" + v4MAC + "/local-ipv4s":            "10.0.1.4\n10.0.1.5",
+		"network/interfaces/macs/" + v4MAC + "/subnet-ipv4-cidr-block": "10.0.1.0/24",
+
+		"network/interfaces/macs/" + v6MAC + "/ipv6s":                   "2001:db8:2::4\n2001:db8:2::5",
+		"network/interfaces/macs/" + v6MAC + "/subnet-ipv6-cidr-blocks": "2001:db8:2::/64",
+	})
+
+	// MACs are shuffled, so try a few times
+	for i := 0; i < 10; i++ {
+		store := NewStore(t.TempDir())
+		a := NewIMDSAllocator(imds, &store, nil)
+
+		ipc, err := a.Get(context.TODO(), "dummy", "eth0", "4")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.1.5/24", ipc.Address.String())
+
+		ipc, err = a.Get(context.TODO(), "dummy", "eth0", "6")
+		require.NoError(t, err)
+		assert.Equal(t, "2001:db8:2::5/64", ipc.Address.String())
+	}
+}
@@ -17,35 +17,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
-	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	cniv1 "github.com/containernetworking/cni/pkg/types/100"
 	cniversion "github.com/containernetworking/cni/pkg/version"
 
+	"github.com/anguslees/aws-cni-plugins/internal/logging"
 	"github.com/anguslees/aws-cni-plugins/internal/metadata"
 )
 
 var version string
 
-const trace = false
+const pluginName = "imds-ipam"
 
 func main() {
-	log.SetFlags(0)
-	log.SetPrefix("CNI imds-ipam: ")
-	log.SetOutput(os.Stderr) // NB: ends up in kubelet syslog
+	logging.Init(pluginName)
 
 	rand.Seed(time.Now().UnixNano())
 
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, cniversion.All, fmt.Sprintf("imds-ipam CNI plugin %s", version))
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, cniversion.All, fmt.Sprintf("%s CNI plugin %s", pluginName, version))
 }
 
 type NetConfIgnoreInterfaceTerm struct {
@@ -64,10 +60,17 @@ type IPAMConf struct {
 
 	// Interfaces to ignore (ignores interfaces matching any term)
 	IgnoreInterfaces []NetConfIgnoreInterfaceTerm `json:"ignoreInterfaces"`
+
+	// Network cards to allocate from.  Default is all cards.
+	NetworkCards []int `json:"networkCards"`
 }
 
 // NetConf is our CNI config structure
 type NetConf struct {
+	// Shared with the main plugin
+	logging.Conf
+	metadata.Source
+
 	CNIVersion string `json:"cniVersion,omitempty"`
 
 	Name string    `json:"name,omitempty"`
@@ -89,19 +92,27 @@ func loadConf(bytes []byte) (*NetConf, *IPAMConf, error) {
 		n.IPAM.IPVersion = "4"
 	}
 
+	if _, err := n.Conf.Level(); err != nil {
+		return nil, nil, err
+	}
+
 	return n, n.IPAM, nil
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	if trace {
-		log.Printf("CHECK: %v", args)
-	}
-
 	netConf, ipamConf, err := loadConf(args.StdinData)
 	if err != nil {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
+	done, err := logging.Setup(pluginName, netConf.Conf, "CHECK", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	slog.Debug("CHECK", "config", string(args.StdinData))
+
 	store := NewStore(filepath.Join(ipamConf.DataDir, netConf.Name))
 	if err := store.Open(); err != nil {
 		return err
@@ -113,9 +124,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return fmt.Errorf("imds-ipam: Failed to find address added by container %s", args.ContainerID)
 	}
 
-	if trace {
-		log.Printf("CHECK returning success")
-	}
+	slog.Debug("CHECK returning success")
 
 	return nil
 }
@@ -123,21 +132,24 @@ func cmdCheck(args *skel.CmdArgs) error {
 func cmdAdd(args *skel.CmdArgs) error {
 	ctx := context.TODO()
 
-	if trace {
-		log.Printf("ADD: %v", args)
+	netConf, ipamConf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
-	netConf, ipamConf, err := loadConf(args.StdinData)
+	done, err := logging.Setup(pluginName, netConf.Conf, "ADD", args)
 	if err != nil {
 		return err
 	}
+	defer done()
+
+	slog.Debug("ADD", "config", string(args.StdinData))
 
-	session, err := session.NewSession()
+	ec2Metadata, err := netConf.Source.New(aws.NewConfig())
 	if err != nil {
 		return err
 	}
-	awsConfig := aws.NewConfig()
-	imds := metadata.NewTypedIMDS(metadata.NewCachedIMDS(ec2metadata.New(session, awsConfig)))
+	imds := metadata.NewTypedIMDS(ec2Metadata)
 
 	result := &cniv1.Result{}
 
@@ -151,7 +163,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}()
 
-	allocator := NewIMDSAllocator(imds, &store)
+	allocator := NewIMDSAllocator(imds, &store, ipamConf.NetworkCards)
 
 	ipConf, err := allocator.Get(ctx, args.ContainerID, args.IfName, ipamConf.IPVersion)
 	if err != nil {
@@ -161,9 +173,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.Routes = ipamConf.Routes
 
-	if trace {
-		log.Printf("ADD returning %v", result)
-	}
+	slog.Debug("ADD returning", "result", result)
 
 	return types.PrintResult(result, netConf.CNIVersion)
 }
@@ -171,21 +181,24 @@ func cmdAdd(args *skel.CmdArgs) error {
 func cmdDel(args *skel.CmdArgs) error {
 	ctx := context.TODO()
 
-	if trace {
-		log.Printf("DEL: %v", args)
+	netConf, ipamConf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
-	netConf, ipamConf, err := loadConf(args.StdinData)
+	done, err := logging.Setup(pluginName, netConf.Conf, "DEL", args)
 	if err != nil {
 		return err
 	}
+	defer done()
+
+	slog.Debug("DEL", "config", string(args.StdinData))
 
-	session, err := session.NewSession()
+	ec2Metadata, err := netConf.Source.New(aws.NewConfig())
 	if err != nil {
 		return err
 	}
-	awsConfig := aws.NewConfig()
-	imds := metadata.NewTypedIMDS(metadata.NewCachedIMDS(ec2metadata.New(session, awsConfig)))
+	imds := metadata.NewTypedIMDS(ec2Metadata)
 
 	store := NewStore(filepath.Join(ipamConf.DataDir, netConf.Name))
 	if err := store.Open(); err != nil {
@@ -197,15 +210,13 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}()
 
-	allocator := NewIMDSAllocator(imds, &store)
+	allocator := NewIMDSAllocator(imds, &store, ipamConf.NetworkCards)
 
 	if err := allocator.Put(ctx, args.ContainerID, args.IfName, ipamConf.IPVersion); err != nil {
 		return err
 	}
 
-	if trace {
-		log.Printf("DEL returning success")
-	}
+	slog.Debug("DEL returning success")
 
 	return nil
 }
@@ -33,6 +33,10 @@ type StoreRow struct {
 	ID     string `json:"id"`
 	IfName string `json:"ifname"`
 	IP     string `json:"ip"` // net.IP doesn't serialize. boo.
+
+	// Network card of the ENI that owns IP.  Device numbers
+	// (and hence ENIs) are only unique within a card.
+	NetworkCard int `json:"networkCard,omitempty"`
 }
 
 type Store struct {
@@ -49,7 +53,7 @@ func NewStore(dir string) Store {
 	}
 }
 
-func (s *Store) ReserveIP(id, ifname string, ip net.IP) error {
+func (s *Store) ReserveIP(id, ifname string, ip net.IP, networkCard int) error {
 	ipstr := ip.String()
 	for _, row := range s.data {
 		if row.IP == ipstr {
@@ -57,7 +61,7 @@ func (s *Store) ReserveIP(id, ifname string, ip net.IP) error {
 		}
 	}
 
-	s.data = append(s.data, StoreRow{ID: id, IfName: ifname, IP: ipstr})
+	s.data = append(s.data, StoreRow{ID: id, IfName: ifname, IP: ipstr, NetworkCard: networkCard})
 	return nil
 }
 
@@ -0,0 +1,145 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+// Anti-spoofing: otherwise a pod could send packets with another
+// pod's (or the node's) VPC IP as source, and policy routing would
+// happily send them out the matching ENI.  Strict rp_filter catches
+// IPv4, and a firewall drop rule catches both families (and doesn't
+// depend on net.ipv4.conf.all.rp_filter, which wins if it is
+// higher).
+//
+// The firewall drop covers both families whatever the pod's IPs, so
+// an IPv4-only pod can't send IPv6 from any address either (and vice
+// versa).
+//
+// ipvlan pods have no host veth, and are not covered.
+
+// antiSpoofVersions returns the IP versions present in ips.
+func antiSpoofVersions(ips []net.IP) []int {
+	var has4, has6 bool
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	var ret []int
+	if has4 {
+		ret = append(ret, 4)
+	}
+	if has6 {
+		ret = append(ret, 6)
+	}
+	return ret
+}
+
+// antiSpoofFirewalls returns the firewalls to configure, for both
+// families.
+func antiSpoofFirewalls(netConf *NetConf) ([]nodeportFirewall, error) {
+	if netConf.Firewall == firewallNftables {
+		// One inet table for both
+		fw, err := newNodeportFirewall(netConf.Firewall, 4)
+		if err != nil {
+			return nil, err
+		}
+		return []nodeportFirewall{fw}, nil
+	}
+
+	var ret []nodeportFirewall
+	for _, v := range []int{4, 6} {
+		fw, err := newNodeportFirewall(netConf.Firewall, v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fw)
+	}
+	return ret, nil
+}
+
+func rpFilterKey(vethName string) string {
+	return fmt.Sprintf("net/ipv4/conf/%s/rp_filter", vethName)
+}
+
+func setupAntiSpoof(procSys procsys.ProcSys, netConf *NetConf, vethName string, ips []net.IP) error {
+	versions := antiSpoofVersions(ips)
+	for _, v := range versions {
+		if v == 4 {
+			if err := procSys.Set(rpFilterKey(vethName), "1"); err != nil {
+				return fmt.Errorf("failed to set rp_filter on %s: %v", vethName, err)
+			}
+		}
+	}
+
+	fws, err := antiSpoofFirewalls(netConf)
+	if err != nil {
+		return err
+	}
+	for _, fw := range fws {
+		if err := fw.SetupAntiSpoof(vethName, ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkAntiSpoof(procSys procsys.ProcSys, netConf *NetConf, vethName string, ips []net.IP) error {
+	versions := antiSpoofVersions(ips)
+	for _, v := range versions {
+		if v == 4 {
+			val, err := procSys.Get(rpFilterKey(vethName))
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(val) != "1" {
+				return fmt.Errorf("rp_filter on %s is %s, expected 1", vethName, strings.TrimSpace(val))
+			}
+		}
+	}
+
+	fws, err := antiSpoofFirewalls(netConf)
+	if err != nil {
+		return err
+	}
+	for _, fw := range fws {
+		if err := fw.CheckAntiSpoof(vethName, ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownAntiSpoof only removes the firewall rules.  The sysctl
+// goes with the veth.
+func teardownAntiSpoof(netConf *NetConf, vethName string) error {
+	fws, err := antiSpoofFirewalls(netConf)
+	if err != nil {
+		return err
+	}
+	for _, fw := range fws {
+		if err := fw.TeardownAntiSpoof(vethName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+func TestAntiSpoofNftables(t *testing.T) {
+	testAntiSpoof(t, &NetConf{Firewall: firewallNftables})
+}
+
+func TestAntiSpoofIptables(t *testing.T) {
+	requireIptables(t)
+	testAntiSpoof(t, &NetConf{Firewall: firewallIptables})
+}
+
+func testAntiSpoof(t *testing.T, netConf *NetConf) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	procSys := procsys.NewProcSys()
+	ips := []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("2001:db8::5")}
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		for _, name := range []string{"veth0", "veth1"} {
+			la := netlink.NewLinkAttrs()
+			la.Name = name
+			require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}))
+		}
+
+		assert.Error(t, checkAntiSpoof(procSys, netConf, "veth0", ips))
+
+		require.NoError(t, setupAntiSpoof(procSys, netConf, "veth0", ips))
+		require.NoError(t, setupAntiSpoof(procSys, netConf, "veth1", ips[:1]))
+		assert.NoError(t, checkAntiSpoof(procSys, netConf, "veth0", ips))
+		assert.NoError(t, checkAntiSpoof(procSys, netConf, "veth1", ips[:1]))
+
+		// An IPv4-only pod still can't send IPv6
+		for _, v := range []int{4, 6} {
+			fw, err := newNodeportFirewall(netConf.Firewall, v)
+			require.NoError(t, err)
+			assert.NoError(t, fw.CheckAntiSpoof("veth1", ips[:1]), "IPv%d", v)
+		}
+
+		// Idempotent
+		require.NoError(t, setupAntiSpoof(procSys, netConf, "veth0", ips))
+		assert.NoError(t, checkAntiSpoof(procSys, netConf, "veth0", ips))
+
+		// Same number of rules, different addresses
+		other := []net.IP{net.ParseIP("10.0.0.6"), net.ParseIP("2001:db8::5")}
+		assert.Error(t, checkAntiSpoof(procSys, netConf, "veth0", other))
+
+		val, err := procSys.Get(rpFilterKey("veth0"))
+		require.NoError(t, err)
+		assert.Equal(t, "1\n", val)
+
+		require.NoError(t, teardownAntiSpoof(netConf, "veth1"))
+		for _, v := range []int{4, 6} {
+			fw, err := newNodeportFirewall(netConf.Firewall, v)
+			require.NoError(t, err)
+			assert.Error(t, fw.CheckAntiSpoof("veth1", ips[:1]), "IPv%d", v)
+		}
+		require.NoError(t, setupAntiSpoof(procSys, netConf, "veth1", ips[:1]))
+
+		require.NoError(t, teardownAntiSpoof(netConf, "veth0"))
+		assert.Error(t, checkAntiSpoof(procSys, netConf, "veth0", ips))
+		assert.NoError(t, checkAntiSpoof(procSys, netConf, "veth1", ips[:1]), "other veth removed")
+
+		// Already removed
+		assert.NoError(t, teardownAntiSpoof(netConf, "veth0"))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
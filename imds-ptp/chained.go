@@ -0,0 +1,294 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	cniversion "github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+// In "chained" mode, another (veth-based) plugin earlier in the
+// chain, eg ptp or bridge, has already called IPAM and created the
+// pod interface.  imds-ptp only does the host routing for the IPs in
+// prevResult: per-ENI setup, the pod route table, the pod source IP
+// policy rules, and the nodeport marks.
+//
+// The host side of the pod is whichever host interface routes to the
+// pod IP (the host veth for ptp, the bridge for bridge).  The pod
+// interface, IPAM, MAC, anti-spoofing, and egress limits are left to
+// the other plugin, and prevResult is passed through unchanged.
+//
+// As in the other modes, ADD records the pod IPs and host interface,
+// so DEL can still clean up without prevResult or a route to the pod.
+
+const modeChained = "chained"
+
+// chainedPrevResult returns the prevResult from the main plugin.
+func chainedPrevResult(netConf *NetConf) (*cniv1.Result, error) {
+	if netConf.RawPrevResult == nil {
+		return nil, fmt.Errorf("mode %q must be called as a chained plugin", modeChained)
+	}
+	if err := cniversion.ParsePrevResult(&netConf.NetConf); err != nil {
+		return nil, err
+	}
+	result, err := cniv1.NewResultFromResult(netConf.PrevResult)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.IPs) == 0 {
+		return nil, fmt.Errorf("prevResult has no IPs")
+	}
+	return result, nil
+}
+
+// chainedHostLink returns the host interface that routes to all of
+// result's IPs.
+func chainedHostLink(result *cniv1.Result) (netlink.Link, error) {
+	var link netlink.Link
+	for _, ipc := range result.IPs {
+		routes, err := netlink.RouteGet(ipc.Address.IP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get route to %s: %v", ipc.Address.IP, err)
+		}
+		if len(routes) == 0 {
+			return nil, fmt.Errorf("no route to %s", ipc.Address.IP)
+		}
+		if link != nil {
+			if routes[0].LinkIndex != link.Attrs().Index {
+				return nil, fmt.Errorf("pod IPs are routed via different host interfaces")
+			}
+			continue
+		}
+		link, err = netlink.LinkByIndex(routes[0].LinkIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup host interface for %s: %v", ipc.Address.IP, err)
+		}
+	}
+	return link, nil
+}
+
+// chainedLinkInUse returns true if other pods are still routed via
+// linkIndex (eg: a bridge), after this pod's routes are removed.
+func chainedLinkInUse(rc RoutingConf, linkIndex int, ipVersion int) (bool, error) {
+	family := unix.AF_INET
+	if ipVersion == 6 {
+		family = unix.AF_INET6
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{
+		Table:     rc.TablePod,
+		LinkIndex: linkIndex,
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes in table %d: %v", rc.TablePod, err)
+	}
+	return len(routes) != 0, nil
+}
+
+func cmdAddChained(args *skel.CmdArgs, netConf *NetConf, tx *undoList) (err error) {
+	result, err := chainedPrevResult(netConf)
+	if err != nil {
+		return err
+	}
+
+	egressLimit, err := podEgressLimit(netConf)
+	if err != nil {
+		return err
+	}
+	if !egressLimit.IsZero() {
+		return fmt.Errorf("egress limits are not supported with mode %q: the host interface belongs to another plugin", modeChained)
+	}
+
+	ec2Metadata, err := newEC2Metadata(netConf)
+	if err != nil {
+		return err
+	}
+
+	procSys := procsys.NewProcSys()
+
+	if err := migrateRouting(netConf.DataDir, netConf.Routing); err != nil {
+		return err
+	}
+
+	if err := ip.EnableForward(result.IPs); err != nil {
+		return fmt.Errorf("could not enable IP forwarding: %v", err)
+	}
+
+	link, err := chainedHostLink(result)
+	if err != nil {
+		return err
+	}
+
+	// NB: err is the named return value.
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	records := newPodRecords(netConf.DataDir)
+	rec := podRecord{VethName: link.Attrs().Name}
+	for _, ipc := range result.IPs {
+		rec.IPs = append(rec.IPs, ipc.Address.IP.String())
+	}
+	err = tx.Do("record pod", func() error {
+		return records.Put(args.ContainerID, args.IfName, rec)
+	}, func() error {
+		return records.Delete(args.ContainerID, args.IfName)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = setupHostEni(ec2Metadata, procSys, netConf, link.Attrs().Name, result, tx); err != nil {
+		return err
+	}
+
+	slog.Debug("ADD returning", "result", result)
+
+	return types.PrintResult(result, netConf.CNIVersion)
+}
+
+func checkChained(netConf *NetConf, result *cniv1.Result) error {
+	ec2Metadata, err := newEC2Metadata(netConf)
+	if err != nil {
+		return err
+	}
+
+	link, err := chainedHostLink(result)
+	if err != nil {
+		return err
+	}
+
+	return checkHostEni(ec2Metadata, procsys.NewProcSys(), netConf, link.Attrs().Name, result)
+}
+
+// cmdDelChained removes the host routing for the IPs in prevResult
+// and/or the pod record.  It runs before the main plugin's DEL, so
+// the pod interface is usually still there.
+func cmdDelChained(args *skel.CmdArgs, netConf *NetConf) error {
+	var podIPs []net.IP
+	var result *cniv1.Result
+	if netConf.RawPrevResult != nil {
+		var err error
+		result, err = chainedPrevResult(netConf)
+		if err != nil {
+			return err
+		}
+		for _, ipc := range result.IPs {
+			podIPs = append(podIPs, ipc.Address.IP)
+		}
+	}
+
+	// Recorded by ADD.  NB: Once the pod is gone, the route to
+	// its IPs may be via some other interface, so the recorded
+	// host interface is preferred over chainedHostLink.
+	records := newPodRecords(netConf.DataDir)
+	rec, err := records.Get(args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	var hostName string
+	if rec != nil {
+		for _, s := range rec.IPs {
+			if ip := net.ParseIP(s); ip != nil {
+				podIPs = append(podIPs, ip)
+			}
+		}
+		hostName = rec.VethName
+	} else if result != nil {
+		// Added by an older version, without a record
+		if link, err := chainedHostLink(result); err == nil {
+			hostName = link.Attrs().Name
+		}
+	}
+
+	if len(podIPs) == 0 {
+		// Nothing to go on
+		return nil
+	}
+
+	// Pod (or bridge) may already be gone, eg: netns deleted
+	var hostLink netlink.Link
+	if hostName != "" {
+		if link, err := netlink.LinkByName(hostName); err == nil {
+			hostLink = link
+		}
+	}
+
+	if err := migrateRouting(netConf.DataDir, netConf.Routing); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(podIPs))
+	for _, podIP := range podIPs {
+		if seen[podIP.String()] {
+			continue
+		}
+		seen[podIP.String()] = true
+
+		if err := teardownHostEniPodRoute(netConf.Routing, podIP); err != nil {
+			return err
+		}
+
+		// As cmdDel
+		if err := flushConntrack(podIP); err != nil {
+			log.Printf("Failed to flush conntrack: %v", err)
+		}
+
+		if hostName == "" {
+			continue
+		}
+		ipVersion := 6
+		if podIP.To4() != nil {
+			ipVersion = 4
+		}
+		if hostLink != nil {
+			inUse, err := chainedLinkInUse(netConf.Routing, hostLink.Attrs().Index, ipVersion)
+			if err != nil {
+				return err
+			}
+			if inUse {
+				continue
+			}
+		}
+		fw, err := newNodeportFirewall(netConf.Firewall, ipVersion)
+		if err != nil {
+			return err
+		}
+		if err := fw.TeardownPod(hostName); err != nil {
+			return err
+		}
+	}
+
+	if err := records.Delete(args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	slog.Debug("DEL returning success")
+
+	return nil
+}
@@ -0,0 +1,449 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+// The functions in this file verify that whatever the corresponding
+// setup* functions did is still present on the host.
+
+// familyMaskLen returns the netlink family and host mask length for ip.
+func familyMaskLen(ip net.IP) (int, int) {
+	if ip.To4() != nil {
+		return unix.AF_INET, 32
+	}
+	return unix.AF_INET6, 128
+}
+
+func sameIPNet(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	return aOnes == bOnes && aBits == bBits && a.IP.Mask(a.Mask).Equal(b.IP.Mask(b.Mask))
+}
+
+// findRoute returns true if a route matching want (by table, dst,
+// and optionally link) exists.
+func findRoute(family int, want netlink.Route) (bool, error) {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: want.Table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes in table %d: %v", want.Table, err)
+	}
+	for _, r := range routes {
+		if want.LinkIndex != 0 && r.LinkIndex != want.LinkIndex {
+			continue
+		}
+		if isDefaultRoute(want.Dst) {
+			if isDefaultRoute(r.Dst) && r.Gw != nil && !r.Gw.IsUnspecified() {
+				return true, nil
+			}
+			continue
+		}
+		if sameIPNet(r.Dst, want.Dst) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findRule returns true if a rule matching want (by priority, table,
+// src and mark) exists.
+func findRule(family int, want *netlink.Rule) (bool, error) {
+	rules, err := netlink.RuleListFiltered(family, want, netlink.RT_FILTER_PRIORITY)
+	if err != nil {
+		return false, fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, r := range rules {
+		if r.Table != want.Table {
+			continue
+		}
+		if want.Src != nil && !sameIPNet(r.Src, want.Src) {
+			continue
+		}
+		if want.Mark != 0 && r.Mark != want.Mark {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func checkHostVeth(vethName string, result *cniv1.Result) error {
+	veth, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup host veth %q: %v", vethName, err)
+	}
+
+	for _, ipc := range result.IPs {
+		family, maskLen := familyMaskLen(ipc.Address.IP)
+
+		addrs, err := netlink.AddrList(veth, family)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses on %s: %v", vethName, err)
+		}
+		gw := &net.IPNet{
+			IP:   ipc.Gateway,
+			Mask: net.CIDRMask(maskLen, maskLen),
+		}
+		var found *netlink.Addr
+		for i := range addrs {
+			if sameIPNet(addrs[i].IPNet, gw) {
+				found = &addrs[i]
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("gateway address %s missing from host veth %s", gw, vethName)
+		}
+		if family == unix.AF_INET6 {
+			if err := checkAddr6(found, vethName); err != nil {
+				return err
+			}
+			if found.Scope != int(netlink.SCOPE_LINK) {
+				return fmt.Errorf("gateway address %s on host veth %s has scope %s, expected link", gw, vethName, netlink.Scope(found.Scope))
+			}
+		}
+
+		route := netlink.Route{
+			Table:     unix.RT_TABLE_MAIN,
+			LinkIndex: veth.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   ipc.Address.IP,
+				Mask: net.CIDRMask(maskLen, maskLen),
+			},
+		}
+		if ok, err := findRoute(family, route); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("host route to %s via %s missing", route.Dst, vethName)
+		}
+	}
+
+	return nil
+}
+
+// checkAddr6 checks that an IPv6 address is usable, ie: not waiting
+// for (or failed) DAD.
+func checkAddr6(addr *netlink.Addr, ifName string) error {
+	switch {
+	case addr.Flags&unix.IFA_F_DADFAILED != 0:
+		return fmt.Errorf("address %s on %s failed duplicate address detection", addr.IPNet, ifName)
+	case addr.Flags&unix.IFA_F_TENTATIVE != 0:
+		return fmt.Errorf("address %s on %s is tentative (duplicate address detection enabled?)", addr.IPNet, ifName)
+	}
+	return nil
+}
+
+// checkContainerAddrs6 checks the IPv6 addresses on the container
+// veth are usable.  Run in the container netns.
+func checkContainerAddrs6(ifName string, result *cniv1.Result) error {
+	if !hasIPVersion(result, false) {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := netlink.AddrList(link, unix.AF_INET6)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses on %s: %v", ifName, err)
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil {
+			continue
+		}
+		for i := range addrs {
+			if addrs[i].IP.Equal(ipc.Address.IP) {
+				if err := checkAddr6(&addrs[i], ifName); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Check ENI interface and primary IP policy route, as configured by
+// setupHostEniIface.
+func checkHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, eniMAC string, ipVersion int) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	getIPs := imds.GetLocalIPv4s
+	getSubnet := imds.GetSubnetIPv4CIDRBlock
+	defaultRoute := net.IPNet{
+		IP:   net.IPv4zero,
+		Mask: net.CIDRMask(0, 32),
+	}
+	family := unix.AF_INET
+	maskLen := 32
+	if ipVersion == 6 {
+		getIPs = imds.GetIPv6s
+		getSubnet = imds.GetSubnetIPv6CIDRBlocks
+		defaultRoute = net.IPNet{
+			IP:   net.IPv6zero,
+			Mask: net.CIDRMask(0, 128),
+		}
+		family = unix.AF_INET6
+		maskLen = 128
+	}
+
+	interfaceByMAC, err := interfacesByMAC()
+	if err != nil {
+		return err
+	}
+
+	primaryMAC, err := imds.GetMAC(ctx)
+	if err != nil {
+		return err
+	}
+	primaryIface := interfaceByMAC[primaryMAC]
+	if primaryIface == nil {
+		return fmt.Errorf("failed to find interface for MAC %s", primaryMAC)
+	}
+
+	rule := netlink.NewRule()
+	rule.Priority = netConf.Routing.PriorityLocalPods
+	rule.Table = netConf.Routing.TablePod
+	if ok, err := findRule(family, rule); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("local pods rule (priority %d, table %d) missing", rule.Priority, rule.Table)
+	}
+
+	fw, err := newNodeportFirewall(netConf.Firewall, ipVersion)
+	if err != nil {
+		return err
+	}
+	if err := fw.CheckPrimary(primaryIface.Name); err != nil {
+		return err
+	}
+
+	rule = netlink.NewRule()
+	rule.Priority = netConf.Routing.PriorityMasq
+	rule.Mark = masqMark
+	rule.Table = unix.RT_TABLE_MAIN
+	if ok, err := findRule(family, rule); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("nodeport fwmark rule (priority %d, mark %#x) missing", rule.Priority, rule.Mark)
+	}
+
+	eniIface, ok := interfaceByMAC[eniMAC]
+	if !ok {
+		return fmt.Errorf("failed to find existing interface with MAC %s", eniMAC)
+	}
+
+	subnet, err := getSubnet(ctx, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	tableIdx, err := eniRouteTable(ctx, imds, netConf.Routing, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	ips, err := getIPs(ctx, eniMAC)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IPv%d addresses found for ENI %s", ipVersion, eniMAC)
+	}
+	eniPrimaryIP := ips[0]
+
+	if ipVersion == 4 {
+		key := fmt.Sprintf("net/ipv4/conf/%s/rp_filter", primaryIface.Name)
+		val, err := procSys.Get(key)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(val) != "2" {
+			return fmt.Errorf("%s is %q, expected \"2\"", key, strings.TrimSpace(val))
+		}
+	}
+
+	for _, r := range []netlink.Route{
+		{
+			Table:     tableIdx,
+			LinkIndex: eniIface.Index,
+			Dst:       &subnet,
+		},
+		{
+			Table:     tableIdx,
+			LinkIndex: eniIface.Index,
+			Dst:       &defaultRoute,
+		},
+	} {
+		if ok, err := findRoute(family, r); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("route to %s dev %s missing from table %d", r.Dst, eniIface.Name, tableIdx)
+		}
+	}
+
+	rule = netlink.NewRule()
+	rule.Priority = netConf.Routing.PriorityOutgoingENI
+	rule.Table = tableIdx
+	rule.Src = &net.IPNet{
+		IP:   eniPrimaryIP,
+		Mask: net.CIDRMask(maskLen, maskLen),
+	}
+	if ok, err := findRule(family, rule); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("ENI primary IP rule (from %s lookup %d) missing", rule.Src, tableIdx)
+	}
+
+	if ipVersion == 4 && eniMAC == primaryMAC {
+		if err := checkExternalSNAT(fw, netConf, primaryIface.Name, eniPrimaryIP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check pod IP policy routes, as configured by setupHostEniPodRoute.
+func checkHostEniPodRoute(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, vethName string, eniMAC string, ipc *cniv1.IPConfig) error {
+	family, maskLen := familyMaskLen(ipc.Address.IP)
+	dst := &net.IPNet{
+		IP:   ipc.Address.IP,
+		Mask: net.CIDRMask(maskLen, maskLen),
+	}
+
+	ipVersion := 6
+	if family == unix.AF_INET {
+		ipVersion = 4
+	}
+
+	veth, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
+	}
+
+	fw, err := newNodeportFirewall(netConf.Firewall, ipVersion)
+	if err != nil {
+		return err
+	}
+	if err := fw.CheckPod(vethName); err != nil {
+		return err
+	}
+
+	route := netlink.Route{
+		Table:     netConf.Routing.TablePod,
+		LinkIndex: veth.Attrs().Index,
+		Dst:       dst,
+	}
+	if ok, err := findRoute(family, route); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("pod route to %s dev %s missing from table %d", dst, vethName, netConf.Routing.TablePod)
+	}
+
+	if err := checkHostEniPodRule(ec2Metadata, netConf, eniMAC, ipc); err != nil {
+		return err
+	}
+
+	return checkHostEniPodHairpin(ec2Metadata, netConf, veth, eniMAC, ipc)
+}
+
+// Check pod IP policy rule, as configured by setupHostEniPodRule.
+func checkHostEniPodRule(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, eniMAC string, ipc *cniv1.IPConfig) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	family, maskLen := familyMaskLen(ipc.Address.IP)
+	dst := &net.IPNet{
+		IP:   ipc.Address.IP,
+		Mask: net.CIDRMask(maskLen, maskLen),
+	}
+
+	tableIdx, err := eniRouteTable(ctx, imds, netConf.Routing, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	rule := netlink.NewRule()
+	rule.Priority = netConf.Routing.PriorityOutgoingENI
+	rule.Table = tableIdx
+	rule.Src = dst
+	if ok, err := findRule(family, rule); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("pod rule (from %s lookup %d) missing", dst, tableIdx)
+	}
+
+	return nil
+}
+
+func checkHostEni(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, vethName string, result *cniv1.Result) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	primaryMAC, err := imds.GetMAC(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ipc := range result.IPs {
+		ipVersion := 6
+		if ipc.Address.IP.To4() != nil {
+			ipVersion = 4
+		}
+
+		eniMAC, err := findEniMAC(ctx, imds, ipc.Address.IP)
+		if err != nil {
+			return err
+		}
+		if err := checkEniAllowed(ctx, imds, netConf, eniMAC); err != nil {
+			return err
+		}
+
+		if err := checkHostEniIface(ec2Metadata, procSys, netConf, eniMAC, ipVersion); err != nil {
+			return err
+		}
+
+		if err := checkHostEniPodRoute(ec2Metadata, netConf, vethName, eniMAC, ipc); err != nil {
+			return err
+		}
+
+		if eniMAC != primaryMAC && !netConf.Secondary {
+			if err := checkHostEniIface(ec2Metadata, procSys, netConf, primaryMAC, ipVersion); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1162 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// test-plugin is in this directory
+const testPluginDir = "../testdata"
+
+var _ = Describe("imds-ptp Operations", func() {
+	var hostNS, podNS ns.NetNS
+	var dataDir string
+	var origPath string
+	var origEC2Metadata func(*NetConf) (metadata.EC2MetadataIface, error)
+
+	const IfName = "eth0"
+
+	// Stand-ins for the ENIs.  The primary ENI is device 0, and
+	// the pod is on device 1 (route table TableENIStart+1).
+	const (
+		primaryMAC = "02:00:00:00:00:01"
+		eniMAC     = "02:00:00:00:00:02"
+	)
+	enis := map[string]string{
+		"ens5": primaryMAC,
+		"ens6": eniMAC,
+	}
+
+	fakeIMDS := metadata.FakeIMDS(map[string]interface{}{
+		"mac":                     primaryMAC,
+		"network/interfaces/macs": primaryMAC + "/\n" + eniMAC + "/",
+
+		"network/interfaces/macs/" + primaryMAC + "/interface-id":            "eni-0001",
+		"network/interfaces/macs/" + primaryMAC + "/device-number":           "0",
+		"network/interfaces/macs/" + primaryMAC + "/local-ipv4s":             "10.0.1.4",
+		"network/interfaces/macs/" + primaryMAC + "/subnet-ipv4-cidr-block":  "10.0.1.0/24",
+		"network/interfaces/macs/" + primaryMAC + "/ipv6s":                   "2001:db8:1::4",
+		"network/interfaces/macs/" + primaryMAC + "/subnet-ipv6-cidr-blocks": "2001:db8:1::/64",
+		"network/interfaces/macs/" + primaryMAC + "/vpc-ipv4-cidr-blocks":    "10.0.0.0/16",
+
+		"network/interfaces/macs/" + eniMAC + "/interface-id":            "eni-0002",
+		"network/interfaces/macs/" + eniMAC + "/device-number":           "1",
+		"network/interfaces/macs/" + eniMAC + "/local-ipv4s":             "10.0.2.4\n10.0.2.20\n10.0.2.21",
+		"network/interfaces/macs/" + eniMAC + "/subnet-ipv4-cidr-block":  "10.0.2.0/24",
+		"network/interfaces/macs/" + eniMAC + "/ipv6s":                   "2001:db8:2::4\n2001:db8:2::20",
+		"network/interfaces/macs/" + eniMAC + "/subnet-ipv6-cidr-blocks": "2001:db8:2::/64",
+	})
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root")
+		}
+
+		extraPath, err := filepath.Abs(testPluginDir)
+		Expect(err).NotTo(HaveOccurred())
+		origPath = os.Getenv("PATH")
+		os.Setenv("PATH", fmt.Sprintf("%s%c%s", extraPath, os.PathListSeparator, origPath))
+
+		origEC2Metadata = newEC2Metadata
+		newEC2Metadata = func(*NetConf) (metadata.EC2MetadataIface, error) {
+			return fakeIMDS, nil
+		}
+
+		dataDir = GinkgoT().TempDir()
+
+		// No RAs in a netns, so pre-seed the IPv6 router cache
+		cache := newRouterCache(dataDir)
+		for _, mac := range enis {
+			Expect(cache.Put(mac, net.ParseIP("fe80::1"))).To(Succeed())
+		}
+	})
+	AfterEach(func() {
+		if origEC2Metadata != nil {
+			newEC2Metadata = origEC2Metadata
+		}
+		if origPath != "" {
+			os.Setenv("PATH", origPath)
+		}
+	})
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		podNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// veth rather than dummy, which isn't in every
+			// kernel
+			for name, mac := range enis {
+				hwaddr, err := net.ParseMAC(mac)
+				Expect(err).NotTo(HaveOccurred())
+				la := netlink.NewLinkAttrs()
+				la.Name = name
+				la.HardwareAddr = hwaddr
+				Expect(netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"})).To(Succeed())
+				peer, err := netlink.LinkByName(name + "p")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(peer)).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		for _, netns := range []ns.NetNS{podNS, hostNS} {
+			if netns != nil {
+				Expect(netns.Close()).To(Succeed())
+				Expect(testutils.UnmountNS(netns)).To(Succeed())
+			}
+		}
+	})
+
+	netConf := func(extra string) string {
+		return fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "mynet",
+  "type": "imds-ptp",
+  "firewall": "nftables",
+  "dataDir": %q,
+  "ipam": {
+    "type": "test-plugin"
+  }%s
+}`, dataDir, extra)
+	}
+
+	sysctl := func(key string) string {
+		val, err := procsys.NewProcSys().Get(key)
+		Expect(err).NotTo(HaveOccurred())
+		return strings.TrimSpace(val)
+	}
+
+	DescribeTable("ADD, CHECK and DEL",
+		func(podAddr, podGW, defaultDst, eniGW string) {
+			podIP, podNet, err := net.ParseCIDR(podAddr)
+			Expect(err).NotTo(HaveOccurred())
+			family, maskLen := familyMaskLen(podIP)
+			ipVersion := 4
+			if family == unix.AF_INET6 {
+				ipVersion = 6
+			}
+			podHost := &net.IPNet{IP: podIP, Mask: net.CIDRMask(maskLen, maskLen)}
+			rc := defaultRoutingConf
+			eniTable := rc.TableENIStart + 1
+
+			os.Setenv("TEST_PLUGIN_RESULT", fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "ips": [{"address": %q, "gateway": %q}],
+  "routes": [{"dst": %q}]
+}`, podAddr, podGW, defaultDst))
+			defer os.Unsetenv("TEST_PLUGIN_RESULT")
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       podNS.Path(),
+				IfName:      IfName,
+				StdinData:   []byte(netConf("")),
+			}
+
+			By("running ADD")
+
+			var resI types.Result
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				resI, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			res, err := cniv1.NewResultFromResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Interfaces).To(HaveLen(2))
+			Expect(res.IPs).To(HaveLen(1))
+			Expect(res.IPs[0].Address.IP.Equal(podIP)).To(BeTrue())
+			vethName := res.Interfaces[0].Name
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				eni, err := netlink.LinkByName("ens6")
+				Expect(err).NotTo(HaveOccurred())
+				veth, err := netlink.LinkByName(vethName)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, rule := range []*netlink.Rule{
+					{Priority: rc.PriorityLocalPods, Table: rc.TablePod},
+					{Priority: rc.PriorityMasq, Table: unix.RT_TABLE_MAIN, Mark: masqMark},
+					{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: podHost},
+					// ENI primary IPs
+					{Priority: rc.PriorityOutgoingENI, Table: rc.TableENIStart, Src: hostIP(fakeIMDS, primaryMAC, family)},
+					{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: hostIP(fakeIMDS, eniMAC, family)},
+				} {
+					Expect(findRule(family, rule)).To(BeTrue(), "rule priority %d table %d src %s", rule.Priority, rule.Table, rule.Src)
+				}
+
+				Expect(findRoute(family, netlink.Route{
+					Table:     rc.TablePod,
+					LinkIndex: veth.Attrs().Index,
+					Dst:       podHost,
+				})).To(BeTrue(), "pod route")
+
+				routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: eniTable}, netlink.RT_FILTER_TABLE)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(ContainElement(And(
+					WithTransform(func(r netlink.Route) bool { return isDefaultRoute(r.Dst) }, BeTrue()),
+					WithTransform(func(r netlink.Route) string { return r.Gw.String() }, Equal(eniGW)),
+					WithTransform(func(r netlink.Route) int { return r.LinkIndex }, Equal(eni.Attrs().Index)),
+				)), "ENI default route")
+				Expect(routes).To(ContainElement(
+					WithTransform(func(r netlink.Route) *net.IPNet { return r.Dst }, Equal(podNet))),
+					"ENI subnet route")
+
+				fw, err := newNodeportFirewall(firewallNftables, ipVersion)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fw.CheckPrimary("ens5")).To(Succeed())
+				Expect(fw.CheckPod(vethName)).To(Succeed())
+				Expect(fw.CheckAntiSpoof(vethName, []net.IP{podIP})).To(Succeed())
+
+				switch family {
+				case unix.AF_INET:
+					Expect(sysctl("net/ipv4/ip_forward")).To(Equal("1"))
+					Expect(sysctl("net/ipv4/conf/ens5/rp_filter")).To(Equal("2"))
+					Expect(sysctl(rpFilterKey(vethName))).To(Equal("1"))
+				case unix.AF_INET6:
+					Expect(sysctl("net/ipv6/conf/all/forwarding")).To(Equal("1"))
+					Expect(sysctl("net/ipv6/conf/ens6/accept_ra")).To(Equal("2"))
+					Expect(sysctl("net/ipv6/conf/" + vethName + "/accept_untracked_na")).To(Equal("1"))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MTU).To(Equal(1500))
+
+				routes, err := netlink.RouteList(link, family)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(ContainElement(And(
+					WithTransform(func(r netlink.Route) bool { return isDefaultRoute(r.Dst) }, BeTrue()),
+					WithTransform(func(r netlink.Route) string { return r.Gw.String() }, Equal(podGW)),
+				)), "pod default route")
+
+				if family == unix.AF_INET6 {
+					Expect(sysctl("net/ipv6/conf/" + IfName + "/accept_dad")).To(Equal("0"))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("running CHECK")
+
+			resJSON, err := json.Marshal(res)
+			Expect(err).NotTo(HaveOccurred())
+			args.StdinData = []byte(netConf(fmt.Sprintf(`,
+  "prevResult": %s`, resJSON)))
+
+			runCheck := func() error {
+				return hostNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+				})
+			}
+			Expect(runCheck()).To(Succeed())
+
+			// CHECK notices a missing pod rule
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				rule := netlink.NewRule()
+				rule.Priority = rc.PriorityOutgoingENI
+				rule.Table = eniTable
+				rule.Src = podHost
+				rule.Family = family
+				return netlink.RuleDel(rule)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runCheck()).To(MatchError(ContainSubstring("missing")))
+
+			By("running DEL")
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, err := netlink.LinkByName(vethName)
+				Expect(err).To(HaveOccurred(), "host veth removed")
+
+				Expect(findRule(family, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: podHost})).To(BeFalse())
+				Expect(findRoute(family, netlink.Route{Table: rc.TablePod, Dst: podHost})).To(BeFalse())
+
+				fw, err := newNodeportFirewall(firewallNftables, ipVersion)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fw.CheckPod(vethName)).NotTo(Succeed())
+
+				// Per-ENI state is shared with other pods, so stays
+				Expect(findRule(family, &netlink.Rule{Priority: rc.PriorityLocalPods, Table: rc.TablePod})).To(BeTrue())
+				Expect(fw.CheckPrimary("ens5")).To(Succeed())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Idempotent
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+			})
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("IPv4", "10.0.2.20/24", "169.254.0.1", "0.0.0.0/0", "10.0.2.1"),
+		Entry("IPv6", "2001:db8:2::20/64", "fe80::1", "::/0", "fe80::1"),
+	)
+
+	DescribeTable("cleans up after the netns is gone, without prevResult",
+		func(withRecord bool) {
+			podIP := net.ParseIP("10.0.2.20")
+			podHost := &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}
+			rc := defaultRoutingConf
+			eniTable := rc.TableENIStart + 1
+
+			os.Setenv("TEST_PLUGIN_RESULT", `{
+  "cniVersion": "1.0.0",
+  "ips": [{"address": "10.0.2.20/24", "gateway": "169.254.0.1"}]
+}`)
+			defer os.Unsetenv("TEST_PLUGIN_RESULT")
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       podNS.Path(),
+				IfName:      IfName,
+				StdinData:   []byte(netConf("")),
+			}
+
+			var resI types.Result
+			err := hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				resI, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := cniv1.NewResultFromResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			vethName := res.Interfaces[0].Name
+
+			By("deleting the pod netns")
+
+			Expect(podNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(podNS)).To(Succeed())
+			podNS = nil
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				// netns cleanup is asynchronous
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					_, err := netlink.LinkByName(vethName)
+					if _, ok := err.(netlink.LinkNotFoundError); ok {
+						return nil
+					}
+					Expect(time.Now().Before(deadline)).To(BeTrue(), "host veth removed with the netns")
+					time.Sleep(10 * time.Millisecond)
+				}
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			if !withRecord {
+				Expect(newPodRecords(dataDir).Delete(args.ContainerID, args.IfName)).To(Succeed())
+			}
+
+			By("running DEL")
+
+			args.Netns = ""
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				fw, err := newNodeportFirewall(firewallNftables, 4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fw.CheckPod(vethName)).NotTo(Succeed())
+				Expect(fw.CheckAntiSpoof(vethName, []net.IP{podIP})).To(MatchError(ContainSubstring("found 0")))
+
+				// The pod route went with the veth
+				Expect(findRoute(unix.AF_INET, netlink.Route{Table: rc.TablePod, Dst: podHost})).To(BeFalse())
+				// Without the pod IPs, there's no way to find
+				// the pod rule
+				Expect(findRule(unix.AF_INET, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: podHost})).To(Equal(!withRecord))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			rec, err := newPodRecords(dataDir).Get(args.ContainerID, args.IfName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rec).To(BeNil())
+		},
+		Entry("from the pod record", true),
+		Entry("without the pod record", false),
+	)
+
+	// wantErr is the CHECK error, with <veth> for the host veth name
+	DescribeTable("CHECK notices missing host state",
+		func(remove func(vethName string) error, wantErr string) {
+			os.Setenv("TEST_PLUGIN_RESULT", `{
+  "cniVersion": "1.0.0",
+  "ips": [{"address": "10.0.2.20/24", "gateway": "169.254.0.1"}]
+}`)
+			defer os.Unsetenv("TEST_PLUGIN_RESULT")
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       podNS.Path(),
+				IfName:      IfName,
+				StdinData:   []byte(netConf("")),
+			}
+
+			var resI types.Result
+			err := hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				resI, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := cniv1.NewResultFromResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			vethName := res.Interfaces[0].Name
+
+			resJSON, err := json.Marshal(res)
+			Expect(err).NotTo(HaveOccurred())
+			args.StdinData = []byte(netConf(fmt.Sprintf(`,
+  "prevResult": %s`, resJSON)))
+
+			runCheck := func() error {
+				return hostNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+				})
+			}
+			Expect(runCheck()).To(Succeed())
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return remove(vethName)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			wantErr = strings.ReplaceAll(wantErr, "<veth>", vethName)
+			Expect(runCheck()).To(MatchError(ContainSubstring(wantErr)))
+		},
+		Entry("veth gateway address", func(vethName string) error {
+			veth, err := netlink.LinkByName(vethName)
+			if err != nil {
+				return err
+			}
+			addr, err := netlink.ParseAddr("169.254.0.1/32")
+			if err != nil {
+				return err
+			}
+			return netlink.AddrDel(veth, addr)
+		}, "gateway address 169.254.0.1/32 missing from host veth <veth>"),
+		Entry("pod route", func(vethName string) error {
+			veth, err := netlink.LinkByName(vethName)
+			if err != nil {
+				return err
+			}
+			_, dst, _ := net.ParseCIDR("10.0.2.20/32")
+			return netlink.RouteDel(&netlink.Route{Table: defaultRoutingConf.TablePod, LinkIndex: veth.Attrs().Index, Dst: dst})
+		}, "pod route to 10.0.2.20/32 dev <veth> missing from table 9"),
+		Entry("pod rule", func(string) error {
+			rule := netlink.NewRule()
+			rule.Priority = defaultRoutingConf.PriorityOutgoingENI
+			rule.Table = defaultRoutingConf.TableENIStart + 1
+			_, rule.Src, _ = net.ParseCIDR("10.0.2.20/32")
+			return netlink.RuleDel(rule)
+		}, "pod rule (from 10.0.2.20/32 lookup 11) missing"),
+		Entry("ENI default route", func(string) error {
+			eni, err := netlink.LinkByName("ens6")
+			if err != nil {
+				return err
+			}
+			_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+			return netlink.RouteDel(&netlink.Route{Table: defaultRoutingConf.TableENIStart + 1, LinkIndex: eni.Attrs().Index, Dst: dst})
+		}, "route to 0.0.0.0/0 dev ens6 missing from table 11"),
+		Entry("nodeport CONNMARK rules", func(string) error {
+			conn, err := nftables.New()
+			if err != nil {
+				return err
+			}
+			conn.FlushChain(nftChain)
+			return conn.Flush()
+		}, `nftables rule "`+nftPrimaryComment+`ens5" missing from `+nftTableName+" "+nftChainName),
+		Entry("pod CONNMARK restore", func(vethName string) error {
+			return nftFirewall{}.TeardownPod(vethName)
+		}, "<veth> missing from nftables set "+nftPodSetName),
+		Entry("veth rp_filter", func(vethName string) error {
+			return procsys.NewProcSys().Set(rpFilterKey(vethName), "0")
+		}, "rp_filter on <veth> is 0, expected 1"),
+		Entry("primary ENI rp_filter", func(string) error {
+			return procsys.NewProcSys().Set("net/ipv4/conf/ens5/rp_filter", "0")
+		}, `net/ipv4/conf/ens5/rp_filter is "0", expected "2"`),
+	)
+
+	DescribeTable("repair restores a pod's host routing",
+		func(podAddr, podGW string) {
+			podIP, _, err := net.ParseCIDR(podAddr)
+			Expect(err).NotTo(HaveOccurred())
+			family, maskLen := familyMaskLen(podIP)
+			podHost := &net.IPNet{IP: podIP, Mask: net.CIDRMask(maskLen, maskLen)}
+			rc := defaultRoutingConf
+			foreignHost := &net.IPNet{IP: net.ParseIP("192.168.5.5"), Mask: net.CIDRMask(32, 32)}
+
+			os.Setenv("TEST_PLUGIN_RESULT", fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "ips": [{"address": %q, "gateway": %q}]
+}`, podAddr, podGW))
+			defer os.Unsetenv("TEST_PLUGIN_RESULT")
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       podNS.Path(),
+				IfName:      IfName,
+				StdinData:   []byte(netConf("")),
+			}
+
+			var resI types.Result
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				resI, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := cniv1.NewResultFromResult(resI)
+			Expect(err).NotTo(HaveOccurred())
+			vethName := res.Interfaces[0].Name
+
+			By("losing host state, for a pod from a version without records")
+			Expect(newPodRecords(dataDir).Delete(args.ContainerID, IfName)).To(Succeed())
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				// NB: Removing the last IPv4 address flushes
+				// IPv4 routes on the link too
+				veth, err := netlink.LinkByName(vethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.RouteDel(&netlink.Route{Table: rc.TablePod, LinkIndex: veth.Attrs().Index, Dst: podHost})).To(Succeed())
+				addrs, err := netlink.AddrList(veth, netlink.FAMILY_ALL)
+				Expect(err).NotTo(HaveOccurred())
+				for _, addr := range addrs {
+					Expect(netlink.AddrDel(veth, &addr)).To(Succeed())
+				}
+				rule := netlink.NewRule()
+				rule.Family = family
+				rule.Priority = rc.PriorityOutgoingENI
+				rule.Table = rc.TableENIStart + 1
+				rule.Src = podHost
+				Expect(netlink.RuleDel(rule)).To(Succeed())
+
+				// Some other plugin's pod
+				la := netlink.NewLinkAttrs()
+				la.Name = "cali0"
+				Expect(netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "foreign0"})).To(Succeed())
+				peer, err := netlink.LinkByName("foreign0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetNsFd(peer, int(podNS.Fd()))).To(Succeed())
+				return podNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					peer, err := netlink.LinkByName("foreign0")
+					Expect(err).NotTo(HaveOccurred())
+					return netlink.AddrAdd(peer, &netlink.Addr{IPNet: foreignHost})
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("running repair")
+			// Not the prefix the pod was added with
+			conf, err := repairConf([]byte(netConf(`,
+  "vethPrefix": "veth"`)))
+			Expect(err).NotTo(HaveOccurred())
+			err = hostNS.Do(func(ns.NetNS) error {
+				return repairHost(fakeIMDS, procsys.NewProcSys(), conf)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			resJSON, err := json.Marshal(res)
+			Expect(err).NotTo(HaveOccurred())
+			args.StdinData = []byte(netConf(fmt.Sprintf(`,
+  "prevResult": %s`, resJSON)))
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(findRule(unix.AF_INET, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: rc.TableENIStart + 1, Src: foreignHost})).To(BeFalse(), "foreign pod")
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("IPv4", "10.0.2.20/24", "169.254.0.1"),
+		Entry("IPv6", "2001:db8:2::20/64", "fe80::1"),
+	)
+
+	// The ENI subnet route isn't part of the cheap verify, so shows
+	// whether the full setup ran again.
+	DescribeTable("ENI setup only runs again when needed",
+		func(mac string, change func(conf *NetConf) error, reconfigured bool) {
+			conf, err := loadConf([]byte(netConf(`,
+  "externalSNAT": true`)))
+			Expect(err).NotTo(HaveOccurred())
+			procSys := procsys.NewProcSys()
+
+			// Device 0 and 1
+			table, subnet := conf.Routing.TableENIStart, "10.0.1.0/24"
+			if mac == eniMAC {
+				table, subnet = conf.Routing.TableENIStart+1, "10.0.2.0/24"
+			}
+			_, dst, _ := net.ParseCIDR(subnet)
+			subnetRoute := netlink.Route{Table: table, Dst: dst, Scope: netlink.SCOPE_LINK}
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(setupHostEniIface(fakeIMDS, procSys, conf, mac, 4)).To(Succeed())
+				Expect(findRoute(unix.AF_INET, subnetRoute)).To(BeTrue())
+				Expect(netlink.RouteDel(&subnetRoute)).To(Succeed())
+
+				Expect(change(conf)).To(Succeed())
+
+				Expect(setupHostEniIface(fakeIMDS, procSys, conf, mac, 4)).To(Succeed())
+				Expect(findRoute(unix.AF_INET, subnetRoute)).To(Equal(reconfigured))
+
+				if reconfigured {
+					// Everything else is back too
+					Expect(checkHostEniIface(fakeIMDS, procSys, conf, mac, 4)).To(Succeed())
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("unchanged", eniMAC, func(*NetConf) error { return nil }, false),
+		Entry("unchanged primary ENI", primaryMAC, func(*NetConf) error { return nil }, false),
+		Entry("fingerprint changed", eniMAC, func(conf *NetConf) error {
+			conf.HairpinENIs = []string{"eni-0002"}
+			return nil
+		}, true),
+		Entry("generation changed", eniMAC, func(conf *NetConf) error {
+			markers := newEniMarkers(conf.DataDir)
+			path := markers.path(eniMAC, 4)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var marker eniMarker
+			if err := json.Unmarshal(data, &marker); err != nil {
+				return err
+			}
+			marker.Generation--
+			data, err = json.Marshal(marker)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, data, 0600)
+		}, true),
+		Entry("ENI rule deleted", eniMAC, func(conf *NetConf) error {
+			rule := netlink.NewRule()
+			rule.Priority = conf.Routing.PriorityOutgoingENI
+			rule.Table = conf.Routing.TableENIStart + 1
+			_, rule.Src, _ = net.ParseCIDR("10.0.2.4/32")
+			return netlink.RuleDel(rule)
+		}, true),
+		Entry("ENI default route deleted", eniMAC, func(conf *NetConf) error {
+			_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+			return netlink.RouteDel(&netlink.Route{Table: conf.Routing.TableENIStart + 1, LinkIndex: mustLinkByName("ens6").Attrs().Index, Dst: dst})
+		}, true),
+		Entry("ENI link down", eniMAC, func(*NetConf) error {
+			return netlink.LinkSetDown(mustLinkByName("ens6"))
+		}, true),
+		Entry("nodeport marking flushed", eniMAC, func(*NetConf) error {
+			conn, err := nftables.New()
+			if err != nil {
+				return err
+			}
+			conn.FlushChain(nftChain)
+			return conn.Flush()
+		}, true),
+		Entry("primary ENI rp_filter reset", eniMAC, func(*NetConf) error {
+			return procsys.NewProcSys().Set("net/ipv4/conf/ens5/rp_filter", "0")
+		}, true),
+		Entry("external SNAT flushed", primaryMAC, func(*NetConf) error {
+			return nftFirewall{}.TeardownSNAT()
+		}, true),
+	)
+
+	It("aborts if chained without a prevResult", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       podNS.Path(),
+			IfName:      IfName,
+			StdinData: []byte(netConf(`,
+  "mode": "chained"`)),
+		}
+
+		err := hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring("must be called as a chained plugin")))
+	})
+
+	It("does host routing only when chained after another plugin", func() {
+		podIP := net.ParseIP("10.0.2.20")
+		podHost := &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}
+		rc := defaultRoutingConf
+		eniTable := rc.TableENIStart + 1
+
+		// What a ptp plugin would have done
+		const vethName = "vethmain0"
+		err := hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			la := netlink.NewLinkAttrs()
+			la.Name = vethName
+			Expect(netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: IfName})).To(Succeed())
+			veth, err := netlink.LinkByName(vethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(veth)).To(Succeed())
+			peer, err := netlink.LinkByName(IfName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(peer, int(podNS.Fd()))).To(Succeed())
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: veth.Attrs().Index, Dst: podHost})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		prevResult := fmt.Sprintf(`{
+    "cniVersion": "1.0.0",
+    "interfaces": [
+      {"name": %q},
+      {"name": %q, "sandbox": %q}
+    ],
+    "ips": [{"address": "10.0.2.20/24", "gateway": "10.0.2.1", "interface": 1}]
+  }`, vethName, IfName, podNS.Path())
+
+		// No ipam: that's the other plugin's job
+		conf := fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "mynet",
+  "type": "imds-ptp",
+  "mode": "chained",
+  "firewall": "nftables",
+  "dataDir": %q,
+  "prevResult": %s
+}`, dataDir, prevResult)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       podNS.Path(),
+			IfName:      IfName,
+			StdinData:   []byte(conf),
+		}
+
+		By("running ADD")
+
+		var resI types.Result
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			resI, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Passed through unchanged
+		res, err := cniv1.NewResultFromResult(resI)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Interfaces).To(HaveLen(2))
+		Expect(res.Interfaces[0].Name).To(Equal(vethName))
+		Expect(res.IPs).To(HaveLen(1))
+		Expect(res.IPs[0].Address.IP.Equal(podIP)).To(BeTrue())
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			veth, err := netlink.LinkByName(vethName)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(findRule(unix.AF_INET, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: podHost})).To(BeTrue())
+			Expect(findRoute(unix.AF_INET, netlink.Route{
+				Table:     rc.TablePod,
+				LinkIndex: veth.Attrs().Index,
+				Dst:       podHost,
+			})).To(BeTrue(), "pod route")
+
+			fw, err := newNodeportFirewall(firewallNftables, 4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fw.CheckPrimary("ens5")).To(Succeed())
+			Expect(fw.CheckPod(vethName)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		rec, err := newPodRecords(dataDir).Get(args.ContainerID, IfName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rec).To(Equal(&podRecord{IPs: []string{"10.0.2.20"}, VethName: vethName}))
+
+		By("running CHECK")
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("running DEL")
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(vethName)
+			Expect(err).NotTo(HaveOccurred(), "host veth belongs to the other plugin")
+
+			Expect(findRule(unix.AF_INET, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: podHost})).To(BeFalse())
+			Expect(findRoute(unix.AF_INET, netlink.Route{Table: rc.TablePod, Dst: podHost})).To(BeFalse())
+
+			fw, err := newNodeportFirewall(firewallNftables, 4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fw.CheckPod(vethName)).NotTo(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName(IfName)
+			Expect(err).NotTo(HaveOccurred(), "pod interface belongs to the other plugin")
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("cleans up a chained pod from its record, after the other plugin's DEL",
+		func(withPrevResult bool) {
+			podIP := net.ParseIP("10.0.2.20")
+			podHost := &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}
+			rc := defaultRoutingConf
+			eniTable := rc.TableENIStart + 1
+
+			// What a ptp plugin would have done
+			const vethName = "vethmain0"
+			err := hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				la := netlink.NewLinkAttrs()
+				la.Name = vethName
+				Expect(netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: IfName})).To(Succeed())
+				veth, err := netlink.LinkByName(vethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(veth)).To(Succeed())
+				peer, err := netlink.LinkByName(IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetNsFd(peer, int(podNS.Fd()))).To(Succeed())
+				return netlink.RouteAdd(&netlink.Route{LinkIndex: veth.Attrs().Index, Dst: podHost})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			prevResult := fmt.Sprintf(`{
+    "cniVersion": "1.0.0",
+    "interfaces": [
+      {"name": %q},
+      {"name": %q, "sandbox": %q}
+    ],
+    "ips": [{"address": "10.0.2.20/24", "gateway": "10.0.2.1", "interface": 1}]
+  }`, vethName, IfName, podNS.Path())
+
+			conf := func(prevResult string) []byte {
+				extra := ""
+				if prevResult != "" {
+					extra = fmt.Sprintf(`,
+  "prevResult": %s`, prevResult)
+				}
+				return []byte(fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "mynet",
+  "type": "imds-ptp",
+  "mode": "chained",
+  "firewall": "nftables",
+  "dataDir": %q%s
+}`, dataDir, extra))
+			}
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       podNS.Path(),
+				IfName:      IfName,
+				StdinData:   conf(prevResult),
+			}
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("removing the pod, as the other plugin's DEL would")
+			err = hostNS.Do(func(ns.NetNS) error {
+				veth, err := netlink.LinkByName(vethName)
+				if err != nil {
+					return err
+				}
+				return netlink.LinkDel(veth)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			if !withPrevResult {
+				args.StdinData = conf("")
+			}
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(findRule(unix.AF_INET, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: podHost})).To(BeFalse())
+				Expect(findRoute(unix.AF_INET, netlink.Route{Table: rc.TablePod, Dst: podHost})).To(BeFalse())
+
+				fw, err := newNodeportFirewall(firewallNftables, 4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fw.CheckPod(vethName)).NotTo(Succeed(), "pod firewall left behind")
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			rec, err := newPodRecords(dataDir).Get(args.ContainerID, IfName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rec).To(BeNil())
+		},
+		Entry("with prevResult", true),
+		Entry("without prevResult", false),
+	)
+
+	It("leaves a shared bridge alone when a chained ADD fails", func() {
+		rc := defaultRoutingConf
+		eniTable := rc.TableENIStart + 1
+		const bridgeName = "cni0"
+
+		// What a bridge plugin would have done
+		err := hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			la := netlink.NewLinkAttrs()
+			la.Name = bridgeName
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: la})).To(Succeed())
+			br, err := netlink.LinkByName(bridgeName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(br)).To(Succeed())
+			_, subnet, _ := net.ParseCIDR("10.0.2.0/24")
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: br.Attrs().Index, Dst: subnet})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		podArgs := func(containerID, podAddr string) *skel.CmdArgs {
+			return &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       podNS.Path(),
+				IfName:      IfName,
+				StdinData: []byte(fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "mynet",
+  "type": "imds-ptp",
+  "mode": "chained",
+  "firewall": "nftables",
+  "dataDir": %q,
+  "prevResult": {
+    "cniVersion": "1.0.0",
+    "interfaces": [
+      {"name": %q},
+      {"name": %q, "sandbox": %q}
+    ],
+    "ips": [{"address": %q, "gateway": "10.0.2.1", "interface": 1}]
+  }
+}`, dataDir, bridgeName, IfName, podNS.Path(), podAddr)),
+			}
+		}
+		argsA := podArgs("podA", "10.0.2.20/24")
+		argsB := podArgs("podB", "10.0.2.21/24")
+		hostA := &net.IPNet{IP: net.ParseIP("10.0.2.20"), Mask: net.CIDRMask(32, 32)}
+		hostB := &net.IPNet{IP: net.ParseIP("10.0.2.21"), Mask: net.CIDRMask(32, 32)}
+
+		addTx := func(args *skel.CmdArgs, tx *undoList) error {
+			return hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAddTx(args, tx)
+				})
+				return err
+			})
+		}
+		add := func(args *skel.CmdArgs) error {
+			return addTx(args, &undoList{})
+		}
+		addFailing := func(args *skel.CmdArgs) error {
+			return addTx(args, &undoList{fault: func(step string) error {
+				if step == "add pod rule" {
+					return errors.New("injected failure")
+				}
+				return nil
+			}})
+		}
+		checkPodB := func() {
+			Expect(findRule(unix.AF_INET, &netlink.Rule{Priority: rc.PriorityOutgoingENI, Table: eniTable, Src: hostB})).To(BeFalse())
+			Expect(findRoute(unix.AF_INET, netlink.Route{Table: rc.TablePod, Dst: hostB})).To(BeFalse())
+		}
+
+		By("adding pod A")
+		Expect(add(argsA)).To(Succeed())
+
+		By("failing to add pod B")
+		Expect(addFailing(argsB)).To(MatchError(ContainSubstring("injected failure")))
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			checkPodB()
+			Expect(findRoute(unix.AF_INET, netlink.Route{Table: rc.TablePod, Dst: hostA})).To(BeTrue(), "pod A route")
+
+			fw, err := newNodeportFirewall(firewallNftables, 4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fw.CheckPod(bridgeName)).To(Succeed(), "still in use by pod A")
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("deleting pod A, then failing to add pod B again")
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(argsA, func() error { return cmdDel(argsA) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(addFailing(argsB)).To(MatchError(ContainSubstring("injected failure")))
+
+		err = hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			checkPodB()
+
+			fw, err := newNodeportFirewall(firewallNftables, 4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fw.CheckPod(bridgeName)).NotTo(Succeed(), "no pods left on the bridge")
+
+			_, err = netlink.LinkByName(bridgeName)
+			Expect(err).NotTo(HaveOccurred(), "bridge belongs to the other plugin")
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+func mustLinkByName(name string) netlink.Link {
+	link, err := netlink.LinkByName(name)
+	Expect(err).NotTo(HaveOccurred())
+	return link
+}
+
+// hostIP returns the (host-reserved) primary address of an ENI, as
+// a host prefix.
+func hostIP(imds metadata.FakeIMDS, mac string, family int) *net.IPNet {
+	key := "network/interfaces/macs/" + mac + "/local-ipv4s"
+	maskLen := 32
+	if family == unix.AF_INET6 {
+		key = "network/interfaces/macs/" + mac + "/ipv6s"
+		maskLen = 128
+	}
+	ip := net.ParseIP(strings.SplitN(imds[key].(string), "\n", 2)[0])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(maskLen, maskLen)}
+}
@@ -0,0 +1,71 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Number of attempts if the conntrack dump is interrupted by
+// concurrent changes (common on a busy node).
+const conntrackFlushAttempts = 3
+
+// flushConntrack deletes conntrack entries to/from podIP, so a new
+// pod reusing the IP doesn't inherit stale flows (in particular UDP,
+// and the nodeport CONNMARK).
+//
+// Matches entries whose original source is podIP (connections from
+// the pod), or whose reply source or destination is podIP
+// (connections to the pod, including after nodeport/service DNAT).
+func flushConntrack(podIP net.IP) error {
+	family := netlink.InetFamily(unix.AF_INET6)
+	if podIP.To4() != nil {
+		family = unix.AF_INET
+	}
+
+	origSrc := &netlink.ConntrackFilter{}
+	if err := origSrc.AddIP(netlink.ConntrackOrigSrcIP, podIP); err != nil {
+		return err
+	}
+	reply := &netlink.ConntrackFilter{}
+	if err := reply.AddIP(netlink.ConntrackReplyAnyIP, podIP); err != nil {
+		return err
+	}
+
+	var err error
+	for i := 0; i < conntrackFlushAttempts; i++ {
+		var n uint
+		n, err = netlink.ConntrackDeleteFilters(netlink.ConntrackTable, family, origSrc, reply)
+		if err == nil {
+			slog.Debug("Deleted conntrack entries", "count", n, "podIP", podIP)
+			return nil
+		}
+		if !errors.Is(err, netlink.ErrDumpInterrupted) {
+			break
+		}
+	}
+
+	if os.IsNotExist(err) || errors.Is(err, unix.EPROTONOSUPPORT) {
+		// No conntrack on this host, so nothing to flush
+		return nil
+	}
+	return fmt.Errorf("failed to delete conntrack entries for %s: %v", podIP, err)
+}
@@ -0,0 +1,92 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func udpFlow(src, dst, replySrc, replyDst string) *netlink.ConntrackFlow {
+	ip := func(s string) net.IP {
+		ip := net.ParseIP(s)
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip
+	}
+	return &netlink.ConntrackFlow{
+		FamilyType: unix.AF_INET,
+		Forward: netlink.IPTuple{
+			SrcIP: ip(src), DstIP: ip(dst),
+			Protocol: unix.IPPROTO_UDP, SrcPort: 1000, DstPort: 53,
+		},
+		Reverse: netlink.IPTuple{
+			SrcIP: ip(replySrc), DstIP: ip(replyDst),
+			Protocol: unix.IPPROTO_UDP, SrcPort: 53, DstPort: 1000,
+		},
+		TimeOut: 100,
+	}
+}
+
+func TestFlushConntrack(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		flows := []*netlink.ConntrackFlow{
+			// from pod
+			udpFlow("10.0.0.5", "8.8.8.8", "8.8.8.8", "10.0.0.5"),
+			// to pod, via DNAT
+			udpFlow("10.1.1.1", "172.20.0.10", "10.0.0.5", "10.1.1.1"),
+			// reply to pod
+			udpFlow("10.1.1.2", "10.0.0.7", "10.0.0.7", "10.0.0.5"),
+			// unrelated
+			udpFlow("10.0.0.6", "8.8.8.8", "8.8.8.8", "10.0.0.6"),
+		}
+		for _, f := range flows {
+			if err := netlink.ConntrackCreate(netlink.ConntrackTable, unix.AF_INET, f); err != nil {
+				t.Skipf("unable to create conntrack entries: %v", err)
+			}
+		}
+
+		require.NoError(t, flushConntrack(net.ParseIP("10.0.0.5")))
+
+		remaining, err := netlink.ConntrackTableList(netlink.ConntrackTable, unix.AF_INET)
+		require.NoError(t, err)
+		if assert.Len(t, remaining, 1) {
+			assert.True(t, remaining[0].Forward.SrcIP.Equal(net.ParseIP("10.0.0.6")))
+		}
+
+		// Nothing left to flush is fine too
+		require.NoError(t, flushConntrack(net.ParseIP("10.0.0.5")))
+		require.NoError(t, flushConntrack(net.ParseIP("fd00::5")))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,1303 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Values for NetConf.Firewall
+const (
+	firewallAuto     = "auto"
+	firewallIptables = "iptables"
+	firewallNftables = "nftables"
+)
+
+// kube-proxy DNATs+MASQUERADEs traffic destined to
+// nodeports. The problem is that this rewrites everything to
+// be to/from primaryIP (eth0) *after* policy routing has
+// already chosen some other interface - rp_filter freaks out,
+// packet goes out wrong interface, etc, etc.
+// Solution: mark packets that look like nodeports in the firewall
+// (before routing), and ensure the routing chooses eth0.
+// Sigh. :(
+
+// nodeportFirewall manages the connection marks that steer nodeport
+// traffic (and replies from pods) via the primary ENI.  It also does
+// the (optional) external SNAT, which is steered the same way.
+type nodeportFirewall interface {
+	// SetupPrimary marks connections arriving on the primary
+	// ENI for a local address.
+	SetupPrimary(primaryIfName string) error
+	// CheckPrimary verifies SetupPrimary is still in effect.
+	CheckPrimary(primaryIfName string) error
+	// SetupPod restores the mark on packets from a pod.
+	SetupPod(vethName string) error
+	// CheckPod verifies SetupPod is still in effect.
+	CheckPod(vethName string) error
+	// TeardownPod undoes SetupPod.  Not an error if already
+	// removed.
+	TeardownPod(vethName string) error
+
+	// SetupSNAT marks forwarded IPv4 connections to anywhere
+	// except exclude, and SNATs them to primaryIP when they leave
+	// via the primary ENI.  Replaces any previous SNAT setup.
+	SetupSNAT(primaryIfName string, primaryIP net.IP, exclude []net.IPNet) error
+	// CheckSNAT verifies SetupSNAT is still in effect.
+	CheckSNAT(primaryIfName string, primaryIP net.IP) error
+	// TeardownSNAT undoes SetupSNAT.  Not an error if already
+	// removed.
+	TeardownSNAT() error
+
+	// SetupAntiSpoof drops packets arriving on vethName with a
+	// source other than ips (or IPv6 link-local/unspecified, for
+	// neighbour discovery).  Replaces any previous setup for
+	// vethName.
+	SetupAntiSpoof(vethName string, ips []net.IP) error
+	// CheckAntiSpoof verifies SetupAntiSpoof is still in effect.
+	CheckAntiSpoof(vethName string, ips []net.IP) error
+	// TeardownAntiSpoof undoes SetupAntiSpoof.  Not an error if
+	// already removed.
+	TeardownAntiSpoof(vethName string) error
+}
+
+// newNodeportFirewall returns the selected firewall backend.
+// ipVersion only matters for iptables; nftables handles both
+// families in one table.
+func newNodeportFirewall(backend string, ipVersion int) (nodeportFirewall, error) {
+	switch backend {
+	case firewallIptables:
+		iptProto := iptables.ProtocolIPv4
+		if ipVersion == 6 {
+			iptProto = iptables.ProtocolIPv6
+		}
+		ipt, err := iptables.NewWithProtocol(iptProto)
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		return iptFirewall{ipt: ipt}, nil
+
+	case firewallNftables:
+		return nftFirewall{}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", backend)
+	}
+}
+
+// firewallFile records the backend in use, in DataDir.
+const firewallFile = "firewall"
+
+// resolveFirewall sets netConf.Firewall to the backend to use.
+// "auto" is only detected once, and the result persisted in
+// DataDir.  If the backend differs from the one last used, the
+// nodeport marking is moved over: see migrateFirewall.  Without a
+// record of the last backend (eg: DataDir on tmpfs, after a reboot),
+// the other backend was only in use if our rules are there.
+func resolveFirewall(netConf *NetConf) error {
+	// Same lock as migrateRouting
+	lock, err := lockRouting(netConf.DataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	path := filepath.Join(netConf.DataDir, firewallFile)
+
+	var have string
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		have = strings.TrimSpace(string(data))
+		if netConf.Firewall == firewallAuto || netConf.Firewall == have {
+			netConf.Firewall = have
+			return nil
+		}
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+
+	want := netConf.Firewall
+	if want == firewallAuto {
+		want = detectFirewall()
+	}
+
+	if have == "" {
+		have, err = previousFirewall(want)
+		if err != nil {
+			return err
+		}
+	}
+
+	if have != "" && have != want {
+		log.Printf("Moving nodeport marking from %s to %s", have, want)
+		if err := migrateFirewall(have, want); err != nil {
+			return fmt.Errorf("failed to move nodeport marking: %v", err)
+		}
+	}
+
+	if err := writeFileAtomic(path, []byte(want)); err != nil {
+		return err
+	}
+	netConf.Firewall = want
+	return nil
+}
+
+// previousFirewall returns the backend other than want, if it has
+// any of our nodeport rules, or "".
+func previousFirewall(want string) (string, error) {
+	switch want {
+	case firewallNftables:
+		for _, ipVersion := range []int{4, 6} {
+			fw, err := newNodeportFirewall(firewallIptables, ipVersion)
+			if err != nil {
+				// No iptables, so no rules
+				return "", nil
+			}
+			if found, err := fw.(iptFirewall).hasNodeportRules(); err != nil {
+				return "", err
+			} else if found {
+				return firewallIptables, nil
+			}
+		}
+
+	case firewallIptables:
+		if found, err := (nftFirewall{}).hasNodeportRules(); err != nil {
+			return "", err
+		} else if found {
+			return firewallNftables, nil
+		}
+	}
+	return "", nil
+}
+
+// migrateFirewall removes the nodeport CONNMARK rules and SNAT from
+// the old backend, and moves existing pods over to the new backend.
+// The primary ENI rules and SNAT are recreated by
+// setupHostEniIface, since the backend is part of eniState.
+func migrateFirewall(from, to string) error {
+	var vethNames []string
+	switch from {
+	case firewallIptables:
+		for _, ipVersion := range []int{4, 6} {
+			fw, err := newNodeportFirewall(firewallIptables, ipVersion)
+			if err != nil {
+				// No iptables, so nothing to remove
+				continue
+			}
+			ipt := fw.(iptFirewall)
+			names, err := ipt.removeNodeportRules()
+			if err != nil {
+				return err
+			}
+			vethNames = append(vethNames, names...)
+			if err := ipt.TeardownSNAT(); err != nil {
+				return err
+			}
+		}
+
+	case firewallNftables:
+		names, err := nftFirewall{}.removeNodeportRules()
+		if err != nil {
+			return err
+		}
+		vethNames = append(vethNames, names...)
+		if err := (nftFirewall{}).TeardownSNAT(); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool, len(vethNames))
+	for _, name := range vethNames {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if _, err := netlink.LinkByName(name); err != nil {
+			// Pod is gone
+			continue
+		}
+		for _, ipVersion := range []int{4, 6} {
+			fw, err := newNodeportFirewall(to, ipVersion)
+			if err != nil {
+				return err
+			}
+			if err := fw.SetupPod(name); err != nil {
+				return err
+			}
+			if to == firewallNftables {
+				// One set for both families
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// detectFirewall prefers nftables, unless iptables-legacy is in use
+// on this host (mixing the two leads to confusion).
+func detectFirewall() string {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return firewallNftables
+	}
+
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return firewallNftables
+	}
+
+	// eg: "iptables v1.8.7 (legacy)" or "iptables v1.8.7 (nf_tables)"
+	// Very old versions don't report a mode, and are legacy.
+	if strings.Contains(string(out), "nf_tables") {
+		return firewallNftables
+	}
+	return firewallIptables
+}
+
+//
+// iptables
+//
+
+type iptFirewall struct {
+	ipt *iptables.IPTables
+}
+
+// iptables rule comments, used to find our rules again.  Older
+// versions used the same comments as aws-vpc-cni ("AWS, ..."), so
+// those can't be told apart from someone else's rules, except by
+// interface (see legacyPodIptRules).
+const (
+	iptPrimaryComment = "imds-ptp, primary ENI"
+	iptPodComment     = "imds-ptp, container return"
+)
+
+func nodeportIptRules(primaryIfName string) [][]string {
+	return [][]string{
+		{
+			"-m", "comment", "--comment", iptPrimaryComment,
+			"-i", primaryIfName,
+			"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
+			"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x/%#x", masqMark, masqMark),
+		},
+	}
+}
+
+func podIptRules(vethName string) [][]string {
+	return [][]string{
+		{
+			"-m", "comment", "--comment", iptPodComment,
+			"-i", vethName, "-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", masqMark),
+		},
+	}
+}
+
+// legacyPodIptRules are podIptRules from older versions.  Only on our
+// own veths, so safe to remove.
+func legacyPodIptRules(vethName string) [][]string {
+	return [][]string{
+		{
+			"-m", "comment", "--comment", "AWS, container return",
+			"-i", vethName, "-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", masqMark),
+		},
+	}
+}
+
+func (f iptFirewall) appendUnique(rules [][]string) error {
+	for _, rule := range rules {
+		if err := f.ipt.AppendUnique("mangle", "PREROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f iptFirewall) exists(rules [][]string) error {
+	for _, rule := range rules {
+		if exists, err := f.ipt.Exists("mangle", "PREROUTING", rule...); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("mangle PREROUTING rule missing: %v", rule)
+		}
+	}
+	return nil
+}
+
+func (f iptFirewall) SetupPrimary(primaryIfName string) error {
+	return f.appendUnique(nodeportIptRules(primaryIfName))
+}
+
+func (f iptFirewall) CheckPrimary(primaryIfName string) error {
+	return f.exists(nodeportIptRules(primaryIfName))
+}
+
+func (f iptFirewall) SetupPod(vethName string) error {
+	return f.appendUnique(podIptRules(vethName))
+}
+
+func (f iptFirewall) CheckPod(vethName string) error {
+	if f.exists(legacyPodIptRules(vethName)) == nil {
+		// Pod from an older version
+		return nil
+	}
+	return f.exists(podIptRules(vethName))
+}
+
+func (f iptFirewall) TeardownPod(vethName string) error {
+	rules := append(podIptRules(vethName), legacyPodIptRules(vethName)...)
+	for _, rule := range rules {
+		if err := f.ipt.DeleteIfExists("mangle", "PREROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasNodeportRules returns true if any primary ENI or pod rules are
+// present.
+func (f iptFirewall) hasNodeportRules() (bool, error) {
+	rules, err := f.ipt.List("mangle", "PREROUTING")
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rules {
+		if strings.Contains(r, `"`+iptPrimaryComment+`"`) || strings.Contains(r, `"`+iptPodComment+`"`) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeNodeportRules removes every primary ENI and pod rule, and
+// returns the pod interface names.
+func (f iptFirewall) removeNodeportRules() ([]string, error) {
+	rules, err := f.ipt.List("mangle", "PREROUTING")
+	if err != nil {
+		return nil, err
+	}
+
+	var vethNames []string
+	for _, r := range rules {
+		// eg: -A PREROUTING -i eni123 -m comment --comment "imds-ptp, container return" -j CONNMARK ...
+		var ifName string
+		fields := strings.Fields(r)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "-i" {
+				ifName = fields[i+1]
+			}
+		}
+
+		var specs [][]string
+		switch {
+		case strings.Contains(r, `"`+iptPrimaryComment+`"`):
+			specs = nodeportIptRules(ifName)
+		case strings.Contains(r, `"`+iptPodComment+`"`):
+			specs = podIptRules(ifName)
+			vethNames = append(vethNames, ifName)
+		default:
+			continue
+		}
+		for _, spec := range specs {
+			if err := f.ipt.DeleteIfExists("mangle", "PREROUTING", spec...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vethNames, nil
+}
+
+const (
+	iptSNATMarkChain = "AWS-SNAT-MARK"
+	iptSNATChain     = "AWS-SNAT"
+)
+
+var iptSNATJumps = []struct {
+	table, chain, target string
+}{
+	{"mangle", "PREROUTING", iptSNATMarkChain},
+	{"nat", "POSTROUTING", iptSNATChain},
+}
+
+func iptSNATJump(target string) []string {
+	return []string{"-m", "comment", "--comment", "AWS, SNAT", "-j", target}
+}
+
+// Only mark the original direction, so replies to connections from
+// outside (eg: via a load balancer) are not SNATed.
+func snatMarkIptRules(primaryIfName string, exclude []net.IPNet) [][]string {
+	rules := [][]string{
+		{"-i", primaryIfName, "-j", "RETURN"},
+		{"-m", "conntrack", "--ctdir", "REPLY", "-j", "RETURN"},
+	}
+	for _, n := range exclude {
+		rules = append(rules, []string{"-d", n.String(), "-j", "RETURN"})
+	}
+	rules = append(rules,
+		[]string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", "RETURN"},
+		[]string{"-j", "MARK", "--set-xmark", fmt.Sprintf("%#x/%#x", snatMark, snatMark)},
+	)
+	return rules
+}
+
+func snatIptRule(primaryIfName string, primaryIP net.IP) []string {
+	return []string{
+		"-o", primaryIfName,
+		"-m", "mark", "--mark", fmt.Sprintf("%#x/%#x", snatMark, snatMark),
+		"-j", "SNAT", "--to-source", primaryIP.String(),
+	}
+}
+
+func (f iptFirewall) SetupSNAT(primaryIfName string, primaryIP net.IP, exclude []net.IPNet) error {
+	// ClearChain creates the chain if necessary
+	if err := f.ipt.ClearChain("mangle", iptSNATMarkChain); err != nil {
+		return err
+	}
+	for _, rule := range snatMarkIptRules(primaryIfName, exclude) {
+		if err := f.ipt.Append("mangle", iptSNATMarkChain, rule...); err != nil {
+			return err
+		}
+	}
+
+	if err := f.ipt.ClearChain("nat", iptSNATChain); err != nil {
+		return err
+	}
+	if err := f.ipt.Append("nat", iptSNATChain, snatIptRule(primaryIfName, primaryIP)...); err != nil {
+		return err
+	}
+
+	for _, j := range iptSNATJumps {
+		if err := f.ipt.AppendUnique(j.table, j.chain, iptSNATJump(j.target)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f iptFirewall) CheckSNAT(primaryIfName string, primaryIP net.IP) error {
+	for _, j := range iptSNATJumps {
+		if exists, err := f.ipt.Exists(j.table, j.chain, iptSNATJump(j.target)...); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("%s %s jump to %s missing", j.table, j.chain, j.target)
+		}
+	}
+
+	rule := snatIptRule(primaryIfName, primaryIP)
+	if exists, err := f.ipt.Exists("nat", iptSNATChain, rule...); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("nat %s rule missing: %v", iptSNATChain, rule)
+	}
+	return nil
+}
+
+func (f iptFirewall) TeardownSNAT() error {
+	for _, j := range iptSNATJumps {
+		if err := f.ipt.DeleteIfExists(j.table, j.chain, iptSNATJump(j.target)...); err != nil {
+			return err
+		}
+		exists, err := f.ipt.ChainExists(j.table, j.target)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := f.ipt.ClearAndDeleteChain(j.table, j.target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Per-veth chain in the raw table, so we don't need to find
+// individual rules again.
+const iptAntiSpoofChainPrefix = "AWS-AS-"
+
+func iptAntiSpoofChain(vethName string) string {
+	return iptAntiSpoofChainPrefix + vethName
+}
+
+func iptAntiSpoofJump(vethName string) []string {
+	return []string{"-m", "comment", "--comment", "AWS, anti-spoof", "-i", vethName, "-j", iptAntiSpoofChain(vethName)}
+}
+
+// antiSpoofIptRules only covers the family of this iptables.
+func (f iptFirewall) antiSpoofIptRules(ips []net.IP) [][]string {
+	v6 := f.ipt.Proto() == iptables.ProtocolIPv6
+
+	var rules [][]string
+	for _, ip := range ips {
+		if (ip.To4() == nil) != v6 {
+			continue
+		}
+		_, maskLen := familyMaskLen(ip)
+		src := net.IPNet{IP: ip, Mask: net.CIDRMask(maskLen, maskLen)}
+		rules = append(rules, []string{"-s", src.String(), "-j", "RETURN"})
+	}
+	if v6 {
+		rules = append(rules,
+			[]string{"-s", "fe80::/10", "-j", "RETURN"},
+			[]string{"-s", "::/128", "-j", "RETURN"},
+		)
+	}
+	return append(rules, []string{"-j", "DROP"})
+}
+
+func (f iptFirewall) SetupAntiSpoof(vethName string, ips []net.IP) error {
+	chain := iptAntiSpoofChain(vethName)
+	if err := f.ipt.ClearChain("raw", chain); err != nil {
+		return err
+	}
+	for _, rule := range f.antiSpoofIptRules(ips) {
+		if err := f.ipt.Append("raw", chain, rule...); err != nil {
+			return err
+		}
+	}
+	return f.ipt.AppendUnique("raw", "PREROUTING", iptAntiSpoofJump(vethName)...)
+}
+
+func (f iptFirewall) CheckAntiSpoof(vethName string, ips []net.IP) error {
+	if exists, err := f.ipt.Exists("raw", "PREROUTING", iptAntiSpoofJump(vethName)...); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("raw PREROUTING anti-spoof rule for %s missing", vethName)
+	}
+
+	chain := iptAntiSpoofChain(vethName)
+	for _, rule := range f.antiSpoofIptRules(ips) {
+		if exists, err := f.ipt.Exists("raw", chain, rule...); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("raw %s rule missing: %v", chain, rule)
+		}
+	}
+	return nil
+}
+
+func (f iptFirewall) TeardownAntiSpoof(vethName string) error {
+	if err := f.ipt.DeleteIfExists("raw", "PREROUTING", iptAntiSpoofJump(vethName)...); err != nil {
+		return err
+	}
+	chain := iptAntiSpoofChain(vethName)
+	exists, err := f.ipt.ChainExists("raw", chain)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return f.ipt.ClearAndDeleteChain("raw", chain)
+	}
+	return nil
+}
+
+//
+// nftables
+//
+
+const (
+	nftTableName          = "aws-cni"
+	nftChainName          = "prerouting"
+	nftPodSetName         = "pod-ifaces"
+	nftSNATMarkChainName  = "snat-prerouting"
+	nftSNATChainName      = "snat-postrouting"
+	nftAntiSpoofChainName = "antispoof"
+
+	// Rule comments, used to find our rules again
+	nftPrimaryComment   = "AWS, primary ENI: "
+	nftPodComment       = "AWS, container return"
+	nftSNATComment      = "AWS, SNAT: "
+	nftAntiSpoofComment = "AWS, anti-spoof: "
+
+	// IP_CT_DIR_REPLY, missing from x/sys/unix
+	nftCtDirReply = 1
+)
+
+// nftFirewall keeps everything in its own inet table, so it never
+// interferes with (or is confused by) other users of nftables.
+type nftFirewall struct{}
+
+var nftTable = &nftables.Table{
+	Family: nftables.TableFamilyINet,
+	Name:   nftTableName,
+}
+
+var nftChain = &nftables.Chain{
+	Name:     nftChainName,
+	Table:    nftTable,
+	Type:     nftables.ChainTypeFilter,
+	Hooknum:  nftables.ChainHookPrerouting,
+	Priority: nftables.ChainPriorityMangle,
+}
+
+var nftSNATMarkChain = &nftables.Chain{
+	Name:     nftSNATMarkChainName,
+	Table:    nftTable,
+	Type:     nftables.ChainTypeFilter,
+	Hooknum:  nftables.ChainHookPrerouting,
+	Priority: nftables.ChainPriorityMangle,
+}
+
+var nftSNATChain = &nftables.Chain{
+	Name:     nftSNATChainName,
+	Table:    nftTable,
+	Type:     nftables.ChainTypeNAT,
+	Hooknum:  nftables.ChainHookPostrouting,
+	Priority: nftables.ChainPriorityNATSource,
+}
+
+// Before conntrack, so spoofed packets don't create entries
+var nftAntiSpoofChain = &nftables.Chain{
+	Name:     nftAntiSpoofChainName,
+	Table:    nftTable,
+	Type:     nftables.ChainTypeFilter,
+	Hooknum:  nftables.ChainHookPrerouting,
+	Priority: nftables.ChainPriorityRaw,
+}
+
+var nftPodSet = &nftables.Set{
+	Table:   nftTable,
+	Name:    nftPodSetName,
+	KeyType: nftables.TypeIFName,
+}
+
+func nftIfName(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// nftPrimaryRule is:
+//
+//	iifname $primary fib daddr . iif type local ct mark set ct mark | $masqMark
+func nftPrimaryRule(primaryIfName string) *nftables.Rule {
+	return &nftables.Rule{
+		Table: nftTable,
+		Chain: nftChain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfName(primaryIfName)},
+			&expr.Fib{Register: 1, FlagDADDR: true, FlagIIF: true, ResultADDRTYPE: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(^uint32(masqMark)),
+				Xor:            binaryutil.NativeEndian.PutUint32(masqMark),
+			},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+		},
+		UserData: userdata.AppendString(nil, userdata.TypeComment, nftPrimaryComment+primaryIfName),
+	}
+}
+
+// nftPodRule is:
+//
+//	iifname @pod-ifaces ct mark & $masqMark == $masqMark meta mark set meta mark | $masqMark
+//
+// This is equivalent to iptables' "--restore-mark --mask $masqMark"
+// for packets that arrive without a mark, which is all of them in
+// prerouting.
+func nftPodRule() *nftables.Rule {
+	return &nftables.Rule{
+		Table: nftTable,
+		Chain: nftChain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Lookup{SourceRegister: 1, SetName: nftPodSet.Name, SetID: nftPodSet.ID},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(masqMark),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(masqMark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(^uint32(masqMark)),
+				Xor:            binaryutil.NativeEndian.PutUint32(masqMark),
+			},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+		},
+		UserData: userdata.AppendString(nil, userdata.TypeComment, nftPodComment),
+	}
+}
+
+func ruleComment(r *nftables.Rule) string {
+	comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+	return comment
+}
+
+// SetupPrimary (re)creates the whole table in one atomic batch.
+// Existing pod set elements are preserved.
+func (f nftFirewall) SetupPrimary(primaryIfName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	conn.AddTable(nftTable)
+	conn.AddChain(nftChain)
+	if err := conn.AddSet(nftPodSet, nil); err != nil {
+		return err
+	}
+	conn.FlushChain(nftChain)
+	conn.AddRule(nftPrimaryRule(primaryIfName))
+	conn.AddRule(nftPodRule())
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to configure nftables table %s: %v", nftTableName, err)
+	}
+	return nil
+}
+
+func (f nftFirewall) CheckPrimary(primaryIfName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	rules, err := conn.GetRules(nftTable, nftChain)
+	if err != nil {
+		return fmt.Errorf("nftables chain %s %s missing: %v", nftTableName, nftChainName, err)
+	}
+
+	wantPrimary := nftPrimaryComment + primaryIfName
+	var foundPrimary, foundPod bool
+	for _, r := range rules {
+		switch ruleComment(r) {
+		case wantPrimary:
+			foundPrimary = true
+		case nftPodComment:
+			foundPod = true
+		}
+	}
+	if !foundPrimary {
+		return fmt.Errorf("nftables rule %q missing from %s %s", wantPrimary, nftTableName, nftChainName)
+	}
+	if !foundPod {
+		return fmt.Errorf("nftables rule %q missing from %s %s", nftPodComment, nftTableName, nftChainName)
+	}
+	return nil
+}
+
+func (f nftFirewall) SetupPod(vethName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	// The set may not exist yet, eg: when moving pods over from
+	// iptables (see migrateFirewall)
+	conn.AddTable(nftTable)
+	elems := []nftables.SetElement{{Key: nftIfName(vethName)}}
+	if err := conn.AddSet(nftPodSet, elems); err != nil {
+		return err
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add %s to nftables set %s: %v", vethName, nftPodSetName, err)
+	}
+	return nil
+}
+
+func (f nftFirewall) hasPod(conn *nftables.Conn, vethName string) (bool, error) {
+	elems, err := conn.GetSetElements(nftPodSet)
+	if err != nil {
+		return false, fmt.Errorf("failed to list nftables set %s: %v", nftPodSetName, err)
+	}
+	key := nftIfName(vethName)
+	for _, e := range elems {
+		if bytes.Equal(e.Key, key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f nftFirewall) CheckPod(vethName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	if ok, err := f.hasPod(conn, vethName); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s missing from nftables set %s", vethName, nftPodSetName)
+	}
+	return nil
+}
+
+func (f nftFirewall) TeardownPod(vethName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	ok, err := f.hasPod(conn, vethName)
+	if err != nil {
+		if _, err := conn.ListTableOfFamily(nftTableName, nftables.TableFamilyINet); err != nil {
+			// No table, nothing to remove
+			return nil
+		}
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	elems := []nftables.SetElement{{Key: nftIfName(vethName)}}
+	if err := conn.SetDeleteElements(nftPodSet, elems); err != nil {
+		return err
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to remove %s from nftables set %s: %v", vethName, nftPodSetName, err)
+	}
+	return nil
+}
+
+// removeNodeportRules removes the nodeport chain and pod set, and
+// returns the pod interface names.
+// hasNodeportRules returns true if our table is present.
+func (f nftFirewall) hasNodeportRules() (bool, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.ListTableOfFamily(nftTableName, nftables.TableFamilyINet); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (f nftFirewall) removeNodeportRules() ([]string, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.ListTableOfFamily(nftTableName, nftables.TableFamilyINet); err != nil {
+		// No table, nothing to remove
+		return nil, nil
+	}
+
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chains {
+		if c.Table.Name == nftTableName && c.Name == nftChainName {
+			conn.FlushChain(nftChain)
+			conn.DelChain(nftChain)
+		}
+	}
+
+	var vethNames []string
+	if elems, err := conn.GetSetElements(nftPodSet); err == nil {
+		for _, e := range elems {
+			vethNames = append(vethNames, string(bytes.TrimRight(e.Key, "\x00")))
+		}
+		conn.DelSet(nftPodSet)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to remove nftables chain %s %s: %v", nftTableName, nftChainName, err)
+	}
+	return vethNames, nil
+}
+
+// nftReturnRule returns a rule in chain that is exprs followed by
+// "return".
+func nftReturnRule(chain *nftables.Chain, exprs ...expr.Any) *nftables.Rule {
+	return &nftables.Rule{
+		Table: nftTable,
+		Chain: chain,
+		Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictReturn}),
+	}
+}
+
+// nftSNATMarkRules are the equivalent of snatMarkIptRules:
+//
+//	meta nfproto != ipv4 return
+//	iifname $primary return
+//	ct direction reply return
+//	ip daddr $exclude return   (for each exclude)
+//	fib daddr type local return
+//	meta mark set meta mark | $snatMark
+func nftSNATMarkRules(primaryIfName string, exclude []net.IPNet) []*nftables.Rule {
+	rules := []*nftables.Rule{
+		nftReturnRule(nftSNATMarkChain,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		),
+		nftReturnRule(nftSNATMarkChain,
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfName(primaryIfName)},
+		),
+		nftReturnRule(nftSNATMarkChain,
+			&expr.Ct{Key: expr.CtKeyDIRECTION, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nftCtDirReply}},
+		),
+	}
+	for _, n := range exclude {
+		ip4 := n.IP.To4()
+		mask := n.Mask
+		if ip4 == nil || len(mask) != net.IPv4len {
+			continue // not IPv4
+		}
+		rules = append(rules, nftReturnRule(nftSNATMarkChain,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           mask,
+				Xor:            []byte{0, 0, 0, 0},
+			},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip4.Mask(mask)},
+		))
+	}
+	rules = append(rules,
+		nftReturnRule(nftSNATMarkChain,
+			&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		),
+		&nftables.Rule{
+			Table: nftTable,
+			Chain: nftSNATMarkChain,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           binaryutil.NativeEndian.PutUint32(^uint32(snatMark)),
+					Xor:            binaryutil.NativeEndian.PutUint32(snatMark),
+				},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+			},
+		},
+	)
+	return rules
+}
+
+// nftSNATRule is:
+//
+//	meta nfproto ipv4 oifname $primary meta mark & $snatMark == $snatMark snat ip to $primaryIP
+func nftSNATRule(primaryIfName string, primaryIP net.IP) *nftables.Rule {
+	return &nftables.Rule{
+		Table: nftTable,
+		Chain: nftSNATChain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfName(primaryIfName)},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(snatMark),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(snatMark)},
+			&expr.Immediate{Register: 1, Data: primaryIP.To4()},
+			&expr.NAT{
+				Type:       expr.NATTypeSourceNAT,
+				Family:     unix.NFPROTO_IPV4,
+				RegAddrMin: 1,
+			},
+		},
+		UserData: userdata.AppendString(nil, userdata.TypeComment, nftSNATComment+primaryIP.String()),
+	}
+}
+
+// SetupSNAT (re)creates both SNAT chains in one atomic batch.
+func (f nftFirewall) SetupSNAT(primaryIfName string, primaryIP net.IP, exclude []net.IPNet) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	conn.AddTable(nftTable)
+	conn.AddChain(nftSNATMarkChain)
+	conn.AddChain(nftSNATChain)
+	conn.FlushChain(nftSNATMarkChain)
+	conn.FlushChain(nftSNATChain)
+	for _, r := range nftSNATMarkRules(primaryIfName, exclude) {
+		conn.AddRule(r)
+	}
+	conn.AddRule(nftSNATRule(primaryIfName, primaryIP))
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to configure nftables SNAT chains: %v", err)
+	}
+	return nil
+}
+
+func (f nftFirewall) CheckSNAT(primaryIfName string, primaryIP net.IP) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.ListChain(nftTable, nftSNATMarkChainName); err != nil {
+		return fmt.Errorf("nftables chain %s %s missing: %v", nftTableName, nftSNATMarkChainName, err)
+	}
+
+	rules, err := conn.GetRules(nftTable, nftSNATChain)
+	if err != nil {
+		return fmt.Errorf("nftables chain %s %s missing: %v", nftTableName, nftSNATChainName, err)
+	}
+	want := nftSNATComment + primaryIP.String()
+	for _, r := range rules {
+		if ruleComment(r) == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("nftables rule %q missing from %s %s", want, nftTableName, nftSNATChainName)
+}
+
+func (f nftFirewall) TeardownSNAT() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, c := range []*nftables.Chain{nftSNATMarkChain, nftSNATChain} {
+		if _, err := conn.ListChain(nftTable, c.Name); err != nil {
+			// Already gone (or no table)
+			continue
+		}
+		conn.DelChain(c)
+		found = true
+	}
+	if !found {
+		return nil
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to remove nftables SNAT chains: %v", err)
+	}
+	return nil
+}
+
+// nftAntiSpoofRules are the equivalent of antiSpoofIptRules, for both
+// families:
+//
+//	iifname $veth ip saddr $ip accept      (for each IPv4 ip)
+//	iifname $veth ip6 saddr $ip accept     (for each IPv6 ip)
+//	iifname $veth ip6 saddr fe80::/10 accept
+//	iifname $veth ip6 saddr :: accept
+//	iifname $veth drop
+func nftAntiSpoofRules(vethName string, ips []net.IP) []*nftables.Rule {
+	comment := userdata.AppendString(nil, userdata.TypeComment, nftAntiSpoofComment+vethName)
+	rule := func(verdict expr.VerdictKind, exprs ...expr.Any) *nftables.Rule {
+		e := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfName(vethName)},
+		}
+		e = append(e, exprs...)
+		e = append(e, &expr.Verdict{Kind: verdict})
+		return &nftables.Rule{
+			Table:    nftTable,
+			Chain:    nftAntiSpoofChain,
+			Exprs:    e,
+			UserData: comment,
+		}
+	}
+	saddr := func(n net.IPNet) []expr.Any {
+		nfproto := byte(unix.NFPROTO_IPV6)
+		offset := uint32(8)
+		ip := n.IP.To16()
+		if ip4 := n.IP.To4(); ip4 != nil {
+			nfproto = unix.NFPROTO_IPV4
+			offset = 12
+			ip = ip4
+		}
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            uint32(len(ip)),
+				Mask:           n.Mask,
+				Xor:            make([]byte, len(ip)),
+			},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(n.Mask)},
+		}
+	}
+
+	var rules []*nftables.Rule
+	for _, ip := range ips {
+		_, maskLen := familyMaskLen(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		rules = append(rules, rule(expr.VerdictAccept, saddr(net.IPNet{IP: ip, Mask: net.CIDRMask(maskLen, maskLen)})...))
+	}
+	rules = append(rules,
+		rule(expr.VerdictAccept, saddr(net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)})...),
+		rule(expr.VerdictAccept, saddr(net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(128, 128)})...),
+		rule(expr.VerdictDrop),
+	)
+	return rules
+}
+
+// antiSpoofRules returns our existing rules for vethName.
+func (f nftFirewall) antiSpoofRules(conn *nftables.Conn, vethName string) ([]*nftables.Rule, error) {
+	rules, err := conn.GetRules(nftTable, nftAntiSpoofChain)
+	if err != nil {
+		return nil, err
+	}
+	want := nftAntiSpoofComment + vethName
+	var ret []*nftables.Rule
+	for _, r := range rules {
+		if ruleComment(r) == want {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// SetupAntiSpoof replaces any existing rules for vethName in one
+// atomic batch.
+func (f nftFirewall) SetupAntiSpoof(vethName string, ips []net.IP) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	conn.AddTable(nftTable)
+	conn.AddChain(nftAntiSpoofChain)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create nftables chain %s %s: %v", nftTableName, nftAntiSpoofChainName, err)
+	}
+
+	old, err := f.antiSpoofRules(conn, vethName)
+	if err != nil {
+		return err
+	}
+	for _, r := range old {
+		if err := conn.DelRule(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range nftAntiSpoofRules(vethName, ips) {
+		conn.AddRule(r)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to configure nftables anti-spoof rules for %s: %v", vethName, err)
+	}
+	return nil
+}
+
+func (f nftFirewall) CheckAntiSpoof(vethName string, ips []net.IP) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	rules, err := f.antiSpoofRules(conn, vethName)
+	if err != nil {
+		return fmt.Errorf("nftables chain %s %s missing: %v", nftTableName, nftAntiSpoofChainName, err)
+	}
+	expected := nftAntiSpoofRules(vethName, ips)
+	if len(rules) != len(expected) {
+		return fmt.Errorf("found %d nftables anti-spoof rules for %s, expected %d", len(rules), vethName, len(expected))
+	}
+	for i := range expected {
+		if have, want := nftRuleString(rules[i]), nftRuleString(expected[i]); have != want {
+			return fmt.Errorf("nftables anti-spoof rule %d for %s is %q, expected %q", i, vethName, have, want)
+		}
+	}
+	return nil
+}
+
+// nftRuleString describes the parts of r's expressions that we set,
+// for comparing against the kernel's version of a rule.
+func nftRuleString(r *nftables.Rule) string {
+	var parts []string
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			parts = append(parts, fmt.Sprintf("meta %d", e.Key))
+		case *expr.Cmp:
+			parts = append(parts, fmt.Sprintf("cmp %d %x", e.Op, e.Data))
+		case *expr.Payload:
+			parts = append(parts, fmt.Sprintf("payload %d %d %d", e.Base, e.Offset, e.Len))
+		case *expr.Bitwise:
+			parts = append(parts, fmt.Sprintf("bitwise %x %x", e.Mask, e.Xor))
+		case *expr.Verdict:
+			parts = append(parts, fmt.Sprintf("verdict %d", e.Kind))
+		default:
+			parts = append(parts, fmt.Sprintf("%T", e))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f nftFirewall) TeardownAntiSpoof(vethName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	rules, err := f.antiSpoofRules(conn, vethName)
+	if err != nil {
+		// No chain (or table), nothing to remove
+		return nil
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	for _, r := range rules {
+		if err := conn.DelRule(r); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to remove nftables anti-spoof rules for %s: %v", vethName, err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func requireIptables(t *testing.T) {
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("requires %s", cmd)
+		}
+	}
+}
+
+// withTestNS runs f in a new netns, with veth0 and veth1.
+func withTestNS(t *testing.T, f func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		for _, name := range []string{"veth0", "veth1"} {
+			la := netlink.NewLinkAttrs()
+			la.Name = name
+			require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}))
+		}
+		f()
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func testNodeportFirewall(t *testing.T, fw nodeportFirewall) {
+	primaryIP := net.ParseIP("10.0.1.4")
+	_, exclude, _ := net.ParseCIDR("10.0.0.0/16")
+
+	assert.Error(t, fw.CheckPrimary("ens5"))
+	require.NoError(t, fw.SetupPrimary("ens5"))
+	assert.NoError(t, fw.CheckPrimary("ens5"))
+	assert.Error(t, fw.CheckPrimary("ens6"))
+	// Idempotent
+	require.NoError(t, fw.SetupPrimary("ens5"))
+	assert.NoError(t, fw.CheckPrimary("ens5"))
+
+	assert.Error(t, fw.CheckPod("veth0"))
+	require.NoError(t, fw.SetupPod("veth0"))
+	require.NoError(t, fw.SetupPod("veth1"))
+	assert.NoError(t, fw.CheckPod("veth0"))
+	assert.NoError(t, fw.CheckPod("veth1"))
+	require.NoError(t, fw.TeardownPod("veth0"))
+	assert.Error(t, fw.CheckPod("veth0"))
+	assert.NoError(t, fw.CheckPod("veth1"), "other pod removed")
+	// Already removed
+	assert.NoError(t, fw.TeardownPod("veth0"))
+	assert.NoError(t, fw.CheckPrimary("ens5"), "primary rule removed")
+
+	assert.Error(t, fw.CheckSNAT("ens5", primaryIP))
+	require.NoError(t, fw.SetupSNAT("ens5", primaryIP, []net.IPNet{*exclude}))
+	assert.NoError(t, fw.CheckSNAT("ens5", primaryIP))
+	assert.Error(t, fw.CheckSNAT("ens5", net.ParseIP("10.0.1.5")))
+	require.NoError(t, fw.TeardownSNAT())
+	assert.Error(t, fw.CheckSNAT("ens5", primaryIP))
+	assert.NoError(t, fw.TeardownSNAT())
+	assert.NoError(t, fw.CheckPod("veth1"), "pod removed with SNAT")
+}
+
+func TestNftFirewall(t *testing.T) {
+	withTestNS(t, func() {
+		fw, err := newNodeportFirewall(firewallNftables, 4)
+		require.NoError(t, err)
+		testNodeportFirewall(t, fw)
+	})
+}
+
+func TestIptFirewall(t *testing.T) {
+	requireIptables(t)
+
+	withTestNS(t, func() {
+		for _, ipVersion := range []int{4, 6} {
+			fw, err := newNodeportFirewall(firewallIptables, ipVersion)
+			require.NoError(t, err)
+			if ipVersion == 4 {
+				testNodeportFirewall(t, fw)
+				continue
+			}
+			// No SNAT for IPv6
+			require.NoError(t, fw.SetupPrimary("ens5"))
+			require.NoError(t, fw.SetupPod("veth0"))
+			assert.NoError(t, fw.CheckPrimary("ens5"))
+			assert.NoError(t, fw.CheckPod("veth0"))
+			require.NoError(t, fw.TeardownPod("veth0"))
+			assert.Error(t, fw.CheckPod("veth0"))
+		}
+	})
+}
+
+func TestResolveFirewall(t *testing.T) {
+	withTestNS(t, func() {
+		dataDir := t.TempDir()
+		path := filepath.Join(dataDir, firewallFile)
+
+		netConf := &NetConf{DataDir: dataDir, Firewall: firewallNftables}
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Equal(t, firewallNftables, netConf.Firewall)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, firewallNftables, string(data))
+
+		// auto is only detected once
+		require.NoError(t, os.WriteFile(path, []byte(firewallIptables), 0600))
+		netConf = &NetConf{DataDir: dataDir, Firewall: firewallAuto}
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Equal(t, firewallIptables, netConf.Firewall)
+
+		require.NoError(t, os.Remove(path))
+		netConf = &NetConf{DataDir: dataDir, Firewall: firewallAuto}
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Equal(t, detectFirewall(), netConf.Firewall)
+		data, err = os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, netConf.Firewall, string(data))
+
+		// After a reboot, with nothing of ours in nftables
+		require.NoError(t, os.Remove(path))
+		nft := nftFirewall{}
+		netConf = &NetConf{DataDir: dataDir, Firewall: firewallIptables}
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Equal(t, firewallIptables, netConf.Firewall)
+
+		// After a reboot, with our nftables rules still there
+		require.NoError(t, nft.SetupPrimary("ens5"))
+		require.NoError(t, os.Remove(path))
+		netConf = &NetConf{DataDir: dataDir, Firewall: firewallIptables}
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Equal(t, firewallIptables, netConf.Firewall)
+		assert.Error(t, nft.CheckPrimary("ens5"), "moved")
+	})
+}
+
+func TestResolveFirewallForeignRules(t *testing.T) {
+	requireIptables(t)
+
+	withTestNS(t, func() {
+		fw, err := newNodeportFirewall(firewallIptables, 4)
+		require.NoError(t, err)
+		ipt := fw.(iptFirewall).ipt
+
+		// aws-vpc-cni's rule, same as older versions of ours
+		foreign := []string{
+			"-m", "comment", "--comment", "AWS, primary ENI",
+			"-i", "ens5", "-j", "CONNMARK", "--set-mark", "0x80/0x80",
+		}
+		require.NoError(t, ipt.Append("mangle", "PREROUTING", foreign...))
+
+		dataDir := t.TempDir()
+		netConf := &NetConf{DataDir: dataDir, Firewall: firewallNftables}
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Equal(t, firewallNftables, netConf.Firewall)
+
+		found, err := ipt.Exists("mangle", "PREROUTING", foreign...)
+		require.NoError(t, err)
+		assert.True(t, found, "not ours to remove")
+		assert.Error(t, nftFirewall{}.CheckPrimary("ens5"), "nothing to migrate")
+
+		// Ours are moved, after a reboot
+		require.NoError(t, fw.SetupPrimary("ens5"))
+		require.NoError(t, os.Remove(filepath.Join(dataDir, firewallFile)))
+		require.NoError(t, resolveFirewall(netConf))
+		assert.Error(t, fw.CheckPrimary("ens5"))
+		found, err = ipt.Exists("mangle", "PREROUTING", foreign...)
+		require.NoError(t, err)
+		assert.True(t, found, "not ours to remove")
+	})
+}
+
+func TestNftRemoveNodeportRules(t *testing.T) {
+	withTestNS(t, func() {
+		fw := nftFirewall{}
+		// Pods first, as migrateFirewall does
+		require.NoError(t, fw.SetupPod("veth0"))
+		require.NoError(t, fw.SetupPrimary("ens5"))
+		require.NoError(t, fw.SetupPod("veth1"))
+		assert.NoError(t, fw.CheckPod("veth0"))
+
+		vethNames, err := fw.removeNodeportRules()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"veth0", "veth1"}, vethNames)
+		assert.Error(t, fw.CheckPrimary("ens5"))
+		assert.Error(t, fw.CheckPod("veth0"))
+
+		// Already removed
+		vethNames, err = fw.removeNodeportRules()
+		require.NoError(t, err)
+		assert.Empty(t, vethNames)
+	})
+}
+
+func TestMigrateFirewall(t *testing.T) {
+	requireIptables(t)
+
+	withTestNS(t, func() {
+		ipt4, err := newNodeportFirewall(firewallIptables, 4)
+		require.NoError(t, err)
+		ipt6, err := newNodeportFirewall(firewallIptables, 6)
+		require.NoError(t, err)
+		nft := nftFirewall{}
+
+		// What an older version left behind, on an
+		// iptables-nft host
+		for _, fw := range []nodeportFirewall{ipt4, ipt6} {
+			require.NoError(t, fw.SetupPrimary("ens5"))
+			require.NoError(t, fw.SetupPod("veth0"))
+			require.NoError(t, fw.SetupPod("vethgone"))
+		}
+		require.NoError(t, ipt4.SetupSNAT("ens5", net.ParseIP("10.0.1.4"), nil))
+
+		require.NoError(t, migrateFirewall(firewallIptables, firewallNftables))
+		for _, fw := range []nodeportFirewall{ipt4, ipt6} {
+			assert.Error(t, fw.CheckPrimary("ens5"))
+			assert.Error(t, fw.CheckPod("veth0"))
+			assert.Error(t, fw.CheckPod("vethgone"))
+		}
+		assert.Error(t, ipt4.CheckSNAT("ens5", net.ParseIP("10.0.1.4")))
+		assert.NoError(t, nft.CheckPod("veth0"))
+		assert.Error(t, nft.CheckPod("vethgone"), "no such interface")
+
+		// And back again
+		require.NoError(t, nft.SetupPrimary("ens5"))
+		require.NoError(t, migrateFirewall(firewallNftables, firewallIptables))
+		assert.Error(t, nft.CheckPrimary("ens5"))
+		assert.NoError(t, ipt4.CheckPod("veth0"))
+		assert.NoError(t, ipt6.CheckPod("veth0"))
+	})
+}
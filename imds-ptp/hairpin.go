@@ -0,0 +1,181 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+// Pods on the same node normally reach each other via the pod route
+// table (at PriorityLocalPods) without leaving the host, so VPC
+// security groups and flow logs never see that traffic.
+//
+// Pods on a "hairpin" ENI instead send traffic for pods on other
+// ENIs out their own ENI, and the VPC delivers it to the other pod's
+// ENI.  A per-pod rule at PriorityHairpin, ahead of the pod table,
+// sends the pod's traffic to its ENI table.  The ENI table also gets
+// routes to pods on the same ENI, since the VPC won't send those back
+// to us.  Nodeport replies and external SNAT (by fwmark) are left to
+// the later rules.
+//
+// This only applies to traffic *from* pods on a hairpin ENI.  Traffic
+// from pods on other ENIs (including replies) is only hairpinned if
+// their ENI is too.  Hairpinned traffic arrives on the other ENI with
+// a source that routes via a local veth, so IPv4 rp_filter is
+// loosened on every ENI while hairpinENIs is set.
+//
+// ptp mode only.
+
+// hairpinENI returns true if eniMAC is a hairpin ENI.
+func hairpinENI(ctx context.Context, imds metadata.TypedIMDS, netConf *NetConf, eniMAC string) (bool, error) {
+	if len(netConf.HairpinENIs) == 0 {
+		return false, nil
+	}
+	ok, _, err := eniInList(ctx, imds, netConf.HairpinENIs, eniMAC)
+	return ok, err
+}
+
+// hairpinRule returns the hairpin rule for a pod IP.
+func hairpinRule(rc RoutingConf, table int, podIP net.IP) *netlink.Rule {
+	_, maskLen := familyMaskLen(podIP)
+
+	rule := netlink.NewRule()
+	rule.Priority = rc.PriorityHairpin
+	rule.Table = table
+	rule.Src = &net.IPNet{
+		IP:   podIP,
+		Mask: net.CIDRMask(maskLen, maskLen),
+	}
+	// Neither mark set
+	mask := uint32(masqMark | snatMark)
+	rule.Mark = 0
+	rule.Mask = &mask
+	return rule
+}
+
+// setupHostEniPodHairpin adds the hairpin rule and same-ENI route for
+// a pod, if it is on a hairpin ENI.
+func setupHostEniPodHairpin(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, veth netlink.Link, eniMAC string, ipc *cniv1.IPConfig, tx *undoList) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	if ok, err := hairpinENI(ctx, imds, netConf, eniMAC); err != nil || !ok {
+		return err
+	}
+
+	tableIdx, err := eniRouteTable(ctx, imds, netConf.Routing, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	rule := hairpinRule(netConf.Routing, tableIdx, ipc.Address.IP)
+
+	// Pods on the same ENI stay local.  Removed along with the
+	// veth.
+	route := netlink.Route{
+		Table:     tableIdx,
+		LinkIndex: veth.Attrs().Index,
+		Dst:       rule.Src,
+		Scope:     netlink.SCOPE_UNIVERSE,
+	}
+	err = tx.Do("add pod hairpin route", func() error {
+		if err := netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to add route (%s): %v", route, err)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Do("add pod hairpin rule", func() error {
+		if err := netlink.RuleAdd(rule); err != nil {
+			if !os.IsExist(err) {
+				return fmt.Errorf("failed to add rule (%s): %v", rule, err)
+			}
+		}
+		return nil
+	}, func() error {
+		return teardownHostEniPodHairpin(netConf.Routing, ipc.Address.IP)
+	})
+}
+
+// checkHostEniPodHairpin checks the state added by
+// setupHostEniPodHairpin.
+func checkHostEniPodHairpin(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, veth netlink.Link, eniMAC string, ipc *cniv1.IPConfig) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	if ok, err := hairpinENI(ctx, imds, netConf, eniMAC); err != nil || !ok {
+		return err
+	}
+
+	tableIdx, err := eniRouteTable(ctx, imds, netConf.Routing, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	family, _ := familyMaskLen(ipc.Address.IP)
+	rule := hairpinRule(netConf.Routing, tableIdx, ipc.Address.IP)
+
+	route := netlink.Route{
+		Table:     tableIdx,
+		LinkIndex: veth.Attrs().Index,
+		Dst:       rule.Src,
+	}
+	if ok, err := findRoute(family, route); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("pod hairpin route to %s missing from table %d", rule.Src, tableIdx)
+	}
+
+	if ok, err := findRule(family, rule); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("pod hairpin rule (from %s lookup %d) missing", rule.Src, tableIdx)
+	}
+
+	return nil
+}
+
+// teardownHostEniPodHairpin removes a pod's hairpin rule, if any.
+// The route goes with the veth.
+func teardownHostEniPodHairpin(rc RoutingConf, podIP net.IP) error {
+	family, _ := familyMaskLen(podIP)
+
+	filter := hairpinRule(rc, 0, podIP)
+	rules, err := netlink.RuleListFiltered(family, filter, netlink.RT_FILTER_PRIORITY|netlink.RT_FILTER_SRC)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if err := netlink.RuleDel(rule); err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete rule (%s): %v", rule, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+func TestHairpin(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	const (
+		hairpinMAC = "02:00:00:00:00:01"
+		otherMAC   = "02:00:00:00:00:02"
+	)
+	ec2Metadata := metadata.FakeIMDS(map[string]interface{}{
+		"network/interfaces/macs/" + hairpinMAC + "/interface-id":  "eni-0001",
+		"network/interfaces/macs/" + hairpinMAC + "/device-number": "1",
+		"network/interfaces/macs/" + otherMAC + "/interface-id":    "eni-0002",
+		"network/interfaces/macs/" + otherMAC + "/device-number":   "2",
+	})
+
+	netConf, err := loadConf([]byte(`{"firewall": "nftables", "hairpinENIs": ["eni-0001"]}`))
+	require.NoError(t, err)
+	hairpinTable := netConf.Routing.TableENIStart + 1
+
+	_, err = loadConf([]byte(`{"firewall": "nftables", "mode": "ipvlan", "hairpinENIs": ["eni-0001"]}`))
+	assert.Error(t, err, "ipvlan")
+
+	ipc := func(s string) *cniv1.IPConfig {
+		return &cniv1.IPConfig{Address: net.IPNet{IP: net.ParseIP(s).To4(), Mask: net.CIDRMask(32, 32)}}
+	}
+	podA := ipc("10.0.1.5")  // hairpin ENI
+	podA2 := ipc("10.0.1.6") // same ENI
+	podB := ipc("10.0.2.7")  // other ENI
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		require.NoError(t, procsys.NewProcSys().Set("net/ipv4/ip_forward", "1"))
+
+		links := make(map[string]netlink.Link)
+		for _, name := range []string{"eni1", "vethA", "vethA2", "vethB"} {
+			la := netlink.NewLinkAttrs()
+			la.Name = name
+			require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}))
+			link, err := netlink.LinkByName(name)
+			require.NoError(t, err)
+			require.NoError(t, netlink.LinkSetUp(link))
+			peer, err := netlink.LinkByName(name + "p")
+			require.NoError(t, err)
+			require.NoError(t, netlink.LinkSetUp(peer))
+			links[name] = link
+		}
+
+		// Enough of setupHostEniIface for the hairpin ENI
+		_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+		require.NoError(t, netlink.AddrAdd(links["eni1"], &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.0.1.4"), Mask: subnet.Mask}}))
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{
+			Table:     hairpinTable,
+			LinkIndex: links["eni1"].Attrs().Index,
+			Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Gw:        net.ParseIP("10.0.1.1"),
+			Flags:     int(netlink.FLAG_ONLINK),
+		}))
+		fw, err := newNodeportFirewall(netConf.Firewall, 4)
+		require.NoError(t, err)
+		require.NoError(t, fw.SetupPrimary("eni1"))
+		rule := netlink.NewRule()
+		rule.Priority = netConf.Routing.PriorityLocalPods
+		rule.Table = netConf.Routing.TablePod
+		require.NoError(t, netlink.RuleAdd(rule))
+
+		for _, p := range []struct {
+			veth string
+			mac  string
+			ipc  *cniv1.IPConfig
+		}{
+			{"vethA", hairpinMAC, podA},
+			{"vethA2", hairpinMAC, podA2},
+			{"vethB", otherMAC, podB},
+		} {
+			require.NoError(t, netlink.RouteAdd(&netlink.Route{LinkIndex: links[p.veth].Attrs().Index, Dst: &p.ipc.Address}))
+			require.NoError(t, setupHostEniPodRoute(ec2Metadata, netConf, p.veth, p.mac, p.ipc, &undoList{}))
+			assert.NoError(t, checkHostEniPodRoute(ec2Metadata, netConf, p.veth, p.mac, p.ipc))
+		}
+
+		routeVia := func(from *cniv1.IPConfig, iif string, to *cniv1.IPConfig, mark uint32) string {
+			routes, err := netlink.RouteGetWithOptions(to.Address.IP, &netlink.RouteGetOptions{
+				SrcAddr: from.Address.IP,
+				Iif:     iif,
+				Mark:    mark,
+			})
+			require.NoError(t, err)
+			require.Len(t, routes, 1)
+			link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+			require.NoError(t, err)
+			return link.Attrs().Name
+		}
+
+		assert.Equal(t, "eni1", routeVia(podA, "vethA", podB, 0), "hairpinned to other ENI")
+		assert.Equal(t, "vethA2", routeVia(podA, "vethA", podA2, 0), "same ENI stays local")
+		assert.Equal(t, "vethA", routeVia(podB, "vethB", podA, 0), "other ENI isn't hairpinned")
+		assert.Equal(t, "vethB", routeVia(podA, "vethA", podB, masqMark), "nodeport reply isn't hairpinned")
+
+		require.NoError(t, teardownHostEniPodRoute(netConf.Routing, podA.Address.IP))
+		assert.Error(t, checkHostEniPodRoute(ec2Metadata, netConf, "vethA", hairpinMAC, podA))
+		assert.Equal(t, "vethB", routeVia(podA, "vethA", podB, 0), "rule removed")
+
+		return nil
+	})
+	require.NoError(t, err)
+}
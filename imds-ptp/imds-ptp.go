@@ -16,16 +16,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	cniv1 "github.com/containernetworking/cni/pkg/types/100"
@@ -33,29 +34,22 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
+	"github.com/anguslees/aws-cni-plugins/internal/logging"
 	"github.com/anguslees/aws-cni-plugins/internal/metadata"
 	"github.com/anguslees/aws-cni-plugins/internal/procsys"
 )
 
 var version string
 
-const trace = false
+const pluginName = "imds-ptp"
 
 const (
-	// Order matters
-	rulePriorityLocalPods   = 30000
-	rulePriorityMasq        = 30010
-	rulePriorityOutgoingENI = 30020
-
 	masqMark = 0x80
-
-	routeTablePod      = 9
-	routeTableENIStart = 10
+	snatMark = 0x100
 )
 
 func init() {
@@ -68,22 +62,257 @@ func init() {
 // NetConf is our CNI config structure
 type NetConf struct {
 	types.NetConf
+	logging.Conf
+	// eniFile, shared with imds-ipam
+	metadata.Source
 
+	// Pod interface and ENI MTU.  0 means inherit from the pod's
+	// ENI (and leave the ENI MTU alone).
 	MTU int `json:"mtu"`
+	// Destinations with a smaller path MTU than the pod
+	// interface (eg: VPN, Transit Gateway, internet)
+	RouteMTUs []RouteMTU `json:"routeMTUs"`
+
+	// Directory for persistent state
+	DataDir string `json:"dataDir"`
+
+	// Maximum time to wait for an IPv6 router advertisement
+	RouterTimeout Duration `json:"routerTimeout"`
+	// Send a router solicitation, rather than wait for the next
+	// unsolicited router advertisement
+	RouterSolicitation bool `json:"routerSolicitation"`
+
+	// Maximum time to wait for a just-attached ENI's interface
+	// to appear
+	LinkTimeout Duration `json:"linkTimeout"`
+	// If set, rename secondary ENI interfaces to this prefix plus
+	// their device number (eg: "eni2", or "eni1-2" on network card
+	// 1)
+	ENINamePrefix string `json:"eniNamePrefix"`
+
+	// Host veth name prefix.  The rest of the name is a hash of
+	// the container ID and interface name.
+	VethPrefix string `json:"vethPrefix"`
+
+	// Firewall backend for nodeport marking: "iptables",
+	// "nftables", or "auto" (default, detected once: see
+	// resolveFirewall)
+	Firewall string `json:"firewall"`
+
+	// Pod interface type: "ptp" (veth, default) or "ipvlan".
+	// See ipvlan.go for what is lost with ipvlan.  "chained"
+	// leaves the pod interface and IPAM to a previous plugin,
+	// and only does host routing (see chained.go).
+	Mode string `json:"mode"`
+	// ipvlan mode: "l3" (default) or "l3s"
+	IPVlanMode string `json:"ipvlanMode"`
+
+	// SNAT pod IPv4 traffic leaving the VPC to the primary ENI
+	// IP, so pods don't need a NAT gateway.
+	ExternalSNAT bool `json:"externalSNAT"`
+	// Destinations outside the VPC that should not be SNATed (eg:
+	// peered VPCs, on-prem)
+	ExcludeSNATCIDRs []types.IPNet `json:"excludeSNATCIDRs"`
+
+	// Policy routing rule priorities and route tables
+	Routing RoutingConf `json:"routing"`
+
+	// Secondary (eg: Multus) attachment: default routes from
+	// IPAM are not installed in the pod, and the primary ENI is
+	// not configured.  See secondary.go.
+	Secondary bool `json:"secondary"`
+	// Only use these ENIs, by ENI ID or MAC.  Empty means any.
+	ENIs []string `json:"enis"`
+
+	// Pods on these ENIs (by ENI ID or MAC) send traffic for pods
+	// on other ENIs via the VPC, rather than directly.  See
+	// hairpin.go.
+	HairpinENIs []string `json:"hairpinENIs"`
+
+	// Default per-pod egress limit.  See policer.go.
+	EgressLimit EgressLimit `json:"egressLimit"`
+	// Allow runtimeConfig and pod annotations to raise (not only
+	// lower) the egress limit.
+	EgressLimitOverride bool `json:"egressLimitOverride"`
+
+	RuntimeConfig struct {
+		Mac            string            `json:"mac,omitempty"`
+		EgressLimit    *EgressLimit      `json:"egressLimit,omitempty"`
+		PodAnnotations map[string]string `json:"io.kubernetes.cri.pod-annotations,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+	Args struct {
+		Cni struct {
+			Mac string `json:"mac,omitempty"`
+		} `json:"cni,omitempty"`
+	} `json:"args,omitempty"`
+}
+
+// Duration is a time.Duration that unmarshals from a string, eg "30s".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 func loadConf(bytes []byte) (*NetConf, error) {
-	n := &NetConf{}
+	n := &NetConf{
+		DataDir:       "/run/cni/imds-ptp",
+		RouterTimeout: Duration{60 * time.Second},
+		LinkTimeout:   Duration{30 * time.Second},
+		VethPrefix:    "eni",
+		Routing:       defaultRoutingConf,
+	}
 
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, err
 	}
 
+	if _, err := n.Conf.Level(); err != nil {
+		return nil, err
+	}
+
+	// See resolveFirewall
+	switch n.Firewall {
+	case "":
+		n.Firewall = firewallAuto
+	case firewallAuto, firewallIptables, firewallNftables:
+	default:
+		return nil, fmt.Errorf("unknown firewall %q", n.Firewall)
+	}
+
+	switch n.Mode {
+	case "":
+		n.Mode = modePtp
+	case modePtp, modeIPVlan, modeChained:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", n.Mode)
+	}
+
+	// Longest suffix is "31-99"
+	if len(n.ENINamePrefix)+5 >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("eniNamePrefix %q too long", n.ENINamePrefix)
+	}
+
+	if n.MTU < 0 {
+		return nil, fmt.Errorf("invalid mtu %d", n.MTU)
+	}
+	if err := validateRouteMTUs(n.RouteMTUs); err != nil {
+		return nil, err
+	}
+
+	if n.VethPrefix == "" || len(n.VethPrefix) > maxVethPrefixLen {
+		return nil, fmt.Errorf("vethPrefix %q must be 1-%d characters", n.VethPrefix, maxVethPrefixLen)
+	}
+
+	if err := n.Routing.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid routing config: %v", err)
+	}
+
+	if len(n.HairpinENIs) != 0 && n.Mode != modePtp {
+		return nil, fmt.Errorf("hairpinENIs requires mode %q", modePtp)
+	}
+
+	switch n.IPVlanMode {
+	case "":
+		n.IPVlanMode = ipvlanModeL3
+	case ipvlanModeL3, ipvlanModeL3S:
+	default:
+		return nil, fmt.Errorf("unknown ipvlanMode %q", n.IPVlanMode)
+	}
+
 	return n, nil
 }
 
+// eniRouteTable returns the policy route table used for the ENI with
+// the given MAC.
+func eniRouteTable(ctx context.Context, imds metadata.TypedIMDS, rc RoutingConf, eniMAC string) (int, error) {
+	card, err := imds.GetNetworkCard(ctx, eniMAC)
+	if err != nil {
+		return 0, err
+	}
+
+	deviceNumber, err := imds.GetDeviceNumber(ctx, eniMAC)
+	if err != nil {
+		return 0, err
+	}
+
+	table := rc.TableENIStart + card*routeTablesPerCard + deviceNumber
+	if table == rc.TablePod || reservedTable(table) {
+		return 0, fmt.Errorf("route table %d for ENI %s (card %d, device %d) collides with another table, try a different tableENIStart", table, eniMAC, card, deviceNumber)
+	}
+	return table, nil
+}
+
+// interfacesByMAC returns the host interfaces, indexed by MAC address.
+func interfacesByMAC() (map[string]*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	interfaceByMAC := make(map[string]*net.Interface, len(ifaces))
+	for i := range ifaces {
+		iface := ifaces[i]
+		interfaceByMAC[iface.HardwareAddr.String()] = &iface
+	}
+	return interfaceByMAC, nil
+}
+
+// findEniMAC returns the MAC of the ENI that owns podIP.
+// errNoENI is returned (wrapped) by findEniMAC when no ENI has the
+// IP.
+var errNoENI = errors.New("no such address on any ENI")
+
+func findEniMAC(ctx context.Context, imds metadata.TypedIMDS, podIP net.IP) (string, error) {
+	getIPs := imds.GetIPv6s
+	if podIP.To4() != nil {
+		getIPs = imds.GetLocalIPv4s
+	}
+
+	macs, err := imds.GetMACs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mac := range macs {
+		ips, err := getIPs(ctx, mac)
+		if metadata.IsNotFound(err) {
+			// ENI without this address family
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		for _, ip := range ips {
+			if ip.Equal(podIP) {
+				return mac, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("failed to find ENI for %s: %w", podIP, errNoENI)
+}
+
 // Mostly based on standard ptp CNI plugin
-func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *cniv1.Result) (*cniv1.Interface, *cniv1.Interface, error) {
+// An empty hostVethName or contVethMac means a random one.
+func setupContainerVeth(netns ns.NetNS, ifName, hostVethName, contVethMac string, mtu int, routeMTUs []RouteMTU, pr *cniv1.Result, tx *undoList) (*cniv1.Interface, *cniv1.Interface, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24, GW=192.168.3.1.
 	// What we want is really a point-to-point link but veth does not support IFF_POINTTOPOINT.
 	// Next best thing would be to let it ARP but set interface to 192.168.3.5/32 and
@@ -99,7 +328,18 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *cniv1.Result
 	containerInterface := &cniv1.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		var hostVeth, contVeth0 net.Interface
+		err := tx.Do("create veth", func() error {
+			var err error
+			hostVeth, contVeth0, err = ip.SetupVethWithName(ifName, hostVethName, mtu, contVethMac, hostNS)
+			return err
+		}, func() error {
+			// Also removes host end of veth, along with
+			// all addresses and routes
+			return netns.Do(func(ns.NetNS) error {
+				return ip.DelLinkByName(ifName)
+			})
+		})
 		if err != nil {
 			return err
 		}
@@ -116,7 +356,41 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *cniv1.Result
 
 		pr.Interfaces = []*cniv1.Interface{hostInterface, containerInterface}
 
-		if err = ipam.ConfigureIface(ifName, pr); err != nil {
+		// Nothing else can be on a ptp veth, so skip DAD
+		// rather than have ConfigureIface wait 1-2s for it.
+		// Must be before the addresses are added.
+		if hasIPVersion(pr, false) {
+			err = tx.Do("disable container veth DAD", func() error {
+				return procsys.NewProcSys().Set("net/ipv6/conf/"+ifName+"/accept_dad", "0")
+			}, nil)
+			if err != nil {
+				return err
+			}
+
+			// Otherwise the host ignores our unsolicited
+			// NA (below).  Kernel 5.18+.
+			err = hostNS.Do(func(ns.NetNS) error {
+				err := procsys.NewProcSys().Set("net/ipv6/conf/"+hostVeth.Name+"/accept_untracked_na", "1")
+				if err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to set accept_untracked_na on %s: %v", hostVeth.Name, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// ConfigureIface would add the IPAM routes via a
+		// gateway that isn't reachable yet (eg: 169.254.0.1
+		// is outside the pod subnet), so they're left to
+		// setupContainerRoutes.
+		addrsOnly := *pr
+		addrsOnly.Routes = nil
+		err = tx.Do("configure container addresses", func() error {
+			return ipam.ConfigureIface(ifName, &addrsOnly)
+		}, nil)
+		if err != nil {
 			return err
 		}
 
@@ -125,57 +399,21 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *cniv1.Result
 			return fmt.Errorf("failed to look up %q: %v", ifName, err)
 		}
 
-		for _, ipc := range pr.IPs {
-			// Delete the route that was automatically added
-			route := netlink.Route{
-				LinkIndex: contVeth.Index,
-				Dst: &net.IPNet{
-					IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
-					Mask: ipc.Address.Mask,
-				},
-				Scope: netlink.SCOPE_NOWHERE,
-			}
-
-			if err := netlink.RouteDel(&route); err != nil {
-				return fmt.Errorf("failed to delete route %v: %v", route, err)
-			}
-
-			addrBits := 128
-			if ipc.Address.IP.To4() != nil {
-				addrBits = 32
-			}
-
-			for _, r := range []netlink.Route{
-				{
-					LinkIndex: contVeth.Index,
-					Dst: &net.IPNet{
-						IP:   ipc.Gateway,
-						Mask: net.CIDRMask(addrBits, addrBits),
-					},
-					Scope: netlink.SCOPE_LINK,
-					Src:   ipc.Address.IP,
-				},
-				{
-					LinkIndex: contVeth.Index,
-					Dst: &net.IPNet{
-						IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
-						Mask: ipc.Address.Mask,
-					},
-					Scope: netlink.SCOPE_UNIVERSE,
-					Gw:    ipc.Gateway,
-					Src:   ipc.Address.IP,
-				},
-			} {
-				if err := netlink.RouteAdd(&r); err != nil {
-					return fmt.Errorf("failed to add route %v: %v", r, err)
-				}
-			}
+		err = tx.Do("configure container routes", func() error {
+			return setupContainerRoutes(contVeth, pr, routeMTUs)
+		}, nil)
+		if err != nil {
+			return err
 		}
 
-		// Send a gratuitous arp for all v4 addresses
+		// Send a gratuitous arp for all v4 addresses, and an
+		// unsolicited neighbour advertisement for all v6
+		// addresses
 		for _, ipc := range pr.IPs {
 			if ipc.Address.IP.To4() != nil {
 				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+			} else if err := sendUnsolicitedNA(contVeth, ipc.Address.IP); err != nil {
+				slog.Debug("Failed to send unsolicited neighbour advertisement", "ip", ipc.Address.IP, "error", err)
 			}
 		}
 
@@ -187,7 +425,88 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, pr *cniv1.Result
 	return hostInterface, containerInterface, nil
 }
 
-func setupHostVeth(vethName string, result *cniv1.Result) error {
+func setupContainerRoutes(contVeth *net.Interface, pr *cniv1.Result, routeMTUs []RouteMTU) error {
+	for _, ipc := range pr.IPs {
+		// Delete the route that was automatically added
+		route := netlink.Route{
+			LinkIndex: contVeth.Index,
+			Dst: &net.IPNet{
+				IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+				Mask: ipc.Address.Mask,
+			},
+			Scope: netlink.SCOPE_NOWHERE,
+		}
+
+		if err := netlink.RouteDel(&route); err != nil {
+			return fmt.Errorf("failed to delete route %v: %v", route, err)
+		}
+
+		addrBits := 128
+		if ipc.Address.IP.To4() != nil {
+			addrBits = 32
+		}
+
+		routes := []netlink.Route{
+			{
+				LinkIndex: contVeth.Index,
+				Dst: &net.IPNet{
+					IP:   ipc.Gateway,
+					Mask: net.CIDRMask(addrBits, addrBits),
+				},
+				Scope: netlink.SCOPE_LINK,
+				Src:   ipc.Address.IP,
+			},
+			{
+				LinkIndex: contVeth.Index,
+				Dst: &net.IPNet{
+					IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+					Mask: ipc.Address.Mask,
+				},
+				Scope: netlink.SCOPE_UNIVERSE,
+				Gw:    ipc.Gateway,
+				Src:   ipc.Address.IP,
+			},
+		}
+		routes = append(routes, containerRouteMTUs(routeMTUs, contVeth.Index, ipc)...)
+		for _, r := range routes {
+			if err := netlink.RouteAdd(&r); err != nil {
+				return fmt.Errorf("failed to add route %v: %v", r, err)
+			}
+		}
+	}
+
+	// IPAM routes, via the gateway for their family by default
+	for _, r := range pr.Routes {
+		gw := r.GW
+		if gw == nil {
+			for _, ipc := range pr.IPs {
+				if (ipc.Address.IP.To4() != nil) == (r.Dst.IP.To4() != nil) {
+					gw = ipc.Gateway
+					break
+				}
+			}
+		}
+		route := netlink.Route{
+			LinkIndex: contVeth.Index,
+			Dst:       &r.Dst,
+			Gw:        gw,
+			Priority:  r.Priority,
+		}
+		if r.Table != nil {
+			route.Table = *r.Table
+		}
+		if r.Scope != nil {
+			route.Scope = netlink.Scope(*r.Scope)
+		}
+		if err := netlink.RouteAdd(&route); err != nil {
+			return fmt.Errorf("failed to add route %v: %v", route, err)
+		}
+	}
+
+	return nil
+}
+
+func setupHostVeth(vethName string, result *cniv1.Result, tx *undoList) error {
 	// hostVeth moved namespaces and may have a new ifindex
 	veth, err := netlink.LinkByName(vethName)
 	if err != nil {
@@ -210,21 +529,39 @@ func setupHostVeth(vethName string, result *cniv1.Result) error {
 			IPNet: ipn,
 			Scope: int(netlink.SCOPE_LINK), // <- ptp uses SCOPE_UNIVERSE here
 		}
-		if err = netlink.AddrAdd(veth, addr); err != nil {
-			return fmt.Errorf("failed to add IP addr (%#v) to veth: %v", ipn, err)
+		if maskLen == 128 {
+			// Usable immediately, not tentative.  Every
+			// host veth has the same (link-local) gateway
+			// address, and nothing else on the link.
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		err = tx.Do("add host veth address", func() error {
+			if err := netlink.AddrAdd(veth, addr); err != nil {
+				return fmt.Errorf("failed to add IP addr (%#v) to veth: %v", ipn, err)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return err
 		}
 
 		ipn = &net.IPNet{
 			IP:   ipc.Address.IP,
 			Mask: net.CIDRMask(maskLen, maskLen),
 		}
-		err := netlink.RouteAdd(&netlink.Route{
-			LinkIndex: veth.Attrs().Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       ipn,
-		})
-		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("failed to add route on host: %v", err)
+		err = tx.Do("add host veth route", func() error {
+			err := netlink.RouteAdd(&netlink.Route{
+				LinkIndex: veth.Attrs().Index,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Dst:       ipn,
+			})
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add route on host: %v", err)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -232,7 +569,7 @@ func setupHostVeth(vethName string, result *cniv1.Result) error {
 }
 
 // Setup ENI interface and primary IP policy route.
-func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, mtu int, vethName string, eniMAC string, ipVersion int) error {
+func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, eniMAC string, ipVersion int) error {
 	ctx := context.TODO()
 
 	imds := metadata.NewTypedIMDS(ec2Metadata)
@@ -245,7 +582,6 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 	}
 	family := unix.AF_INET
 	maskLen := 32
-	iptProto := iptables.ProtocolIPv4
 	if ipVersion == 6 {
 		getIPs = imds.GetIPv6s
 		getSubnet = imds.GetSubnetIPv6CIDRBlocks
@@ -255,70 +591,118 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 		}
 		family = unix.AF_INET6
 		maskLen = 128
-		iptProto = iptables.ProtocolIPv6
 	}
 
-	ipt, err := iptables.NewWithProtocol(iptProto)
+	interfaceByMAC, err := interfacesByMAC()
 	if err != nil {
 		return err
 	}
 
-	ifaces, err := net.Interfaces()
+	primaryMAC, err := imds.GetMAC(ctx)
 	if err != nil {
 		return err
 	}
-	interfaceByMAC := make(map[string]*net.Interface, len(ifaces))
-	for i := range ifaces {
-		iface := ifaces[i]
-		interfaceByMAC[iface.HardwareAddr.String()] = &iface
+	primaryIface := interfaceByMAC[primaryMAC]
+	if primaryIface == nil {
+		return fmt.Errorf("failed to find interface for MAC %s", primaryMAC)
 	}
 
-	primaryMAC, err := imds.GetMAC(ctx)
+	eniLink, err := waitForLinkByMAC(eniMAC, netConf.LinkTimeout.Duration)
 	if err != nil {
 		return err
 	}
-	primaryIface := interfaceByMAC[primaryMAC]
-	if primaryIface == nil {
-		return fmt.Errorf("failed to find interface for MAC %s", primaryMAC)
+	if eniMAC != primaryMAC {
+		eniLink, err = renameEniLink(ctx, imds, netConf, eniMAC, eniLink)
+		if err != nil {
+			return err
+		}
+	}
+	eniIface := eniLink.Attrs()
+
+	subnet, err := getSubnet(ctx, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	tableIdx, err := eniRouteTable(ctx, imds, netConf.Routing, eniMAC)
+	if err != nil {
+		return err
+	}
+
+	ips, err := getIPs(ctx, eniMAC)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IPv%d addresses found for ENI %s", ipVersion, eniMAC)
+	}
+	eniPrimaryIP := ips[0] // Reserve 'primary' (first) IP address for hostns
+
+	// External SNAT is node-wide, so done along with the primary
+	// ENI.
+	snat := ipVersion == 4 && eniMAC == primaryMAC
+	var snatExclude []net.IPNet
+	if snat && netConf.ExternalSNAT {
+		snatExclude, err = externalSNATExclusions(ctx, imds, netConf, primaryMAC)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Everything below is only done once per ENI, unless
+	// something changed.
+	state := eniState{
+		IPVersion:    ipVersion,
+		MTU:          netConf.MTU,
+		PrimaryIface: primaryIface.Name,
+		Iface:        eniIface.Name,
+		IfIndex:      eniIface.Index,
+		Subnet:       subnet.String(),
+		PrimaryIP:    eniPrimaryIP.String(),
+		Table:        tableIdx,
+		Firewall:     netConf.Firewall,
+		Routing:      netConf.Routing,
+		RouteMTUs:    routeMTUsFor(netConf.RouteMTUs, ipVersion),
+		Hairpin:      len(netConf.HairpinENIs) != 0,
+	}
+	if snat && netConf.ExternalSNAT {
+		state.SNATExclude = cidrStrings(snatExclude)
+	}
+	markers := newEniMarkers(netConf.DataDir)
+	if configured, err := markers.Configured(eniMAC, state); err != nil {
+		return err
+	} else if configured {
+		err := verifyHostEniIface(eniLink, netConf.MTU, netConf.Routing, family, eniPrimaryIP, tableIdx)
+		if err == nil {
+			err = verifyHostEniNode(procSys, netConf, state, snat, eniPrimaryIP)
+		}
+		if err == nil {
+			return nil
+		}
+		log.Printf("Reconfiguring ENI %s: %v", eniMAC, err)
+	}
+
+	fw, err := newNodeportFirewall(netConf.Firewall, ipVersion)
+	if err != nil {
+		return err
 	}
 
 	rule := netlink.NewRule()
-	rule.Priority = rulePriorityLocalPods
+	rule.Priority = netConf.Routing.PriorityLocalPods
 	rule.Family = family
-	rule.Table = routeTablePod
+	rule.Table = netConf.Routing.TablePod
 	if err := netlink.RuleAdd(rule); err != nil {
 		if !os.IsExist(err) {
 			return fmt.Errorf("failed to add rule: %v", err)
 		}
 	}
 
-	// kube-proxy DNATs+MASQUERADEs traffic destined to
-	// nodeports. The problem is that this rewrites everything to
-	// be to/from primaryIP (eth0) *after* policy routing has
-	// already chosen some other interface - rp_filter freaks out,
-	// packet goes out wrong interface, etc, etc.
-	// Solution: mark packets that look like nodeports in iptables
-	// (before routing), and ensure the routing chooses eth0.
-	// Sigh. :(
-	iptRules := [][]string{
-		{
-			"-m", "comment", "--comment", "AWS, primary ENI",
-			"-i", primaryIface.Name,
-			"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in",
-			"-j", "CONNMARK", "--set-mark", fmt.Sprintf("%#x/%#x", masqMark, masqMark),
-		},
-		{
-			"-m", "comment", "--comment", "AWS, container return",
-			"-i", vethName, "-j", "CONNMARK", "--restore-mark", "--mask", fmt.Sprintf("%#x", masqMark),
-		},
-	}
-	for _, iptRule := range iptRules {
-		if err := ipt.AppendUnique("mangle", "PREROUTING", iptRule...); err != nil {
-			return err
-		}
+	// Steer nodeport traffic back out the primary ENI.
+	if err := fw.SetupPrimary(primaryIface.Name); err != nil {
+		return err
 	}
 	rule = netlink.NewRule()
-	rule.Priority = rulePriorityMasq
+	rule.Priority = netConf.Routing.PriorityMasq
 	mask := uint32(masqMark)
 	rule.Mark = mask
 	rule.Mask = &mask
@@ -330,42 +714,22 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 		}
 	}
 
-	eniIface, ok := interfaceByMAC[eniMAC]
-	if !ok {
-		return fmt.Errorf("failed to find existing interface with MAC %s", eniMAC)
-	}
-
-	subnet, err := getSubnet(ctx, eniMAC)
-	if err != nil {
-		return err
-	}
-
-	deviceNumber, err := imds.GetDeviceNumber(ctx, eniMAC)
-	if err != nil {
-		return err
-	}
-
-	tableIdx := routeTableENIStart + deviceNumber
-
-	eniLink, err := netlink.LinkByIndex(eniIface.Index)
-	if err != nil {
-		return err
+	if snat {
+		if err := setupExternalSNAT(fw, netConf, primaryIface.Name, eniPrimaryIP, snatExclude); err != nil {
+			return err
+		}
 	}
 
-	if err := netlink.LinkSetMTU(eniLink, mtu); err != nil {
-		return err
+	if netConf.MTU != 0 {
+		if err := netlink.LinkSetMTU(eniLink, netConf.MTU); err != nil {
+			return err
+		}
 	}
 
 	if err := netlink.LinkSetUp(eniLink); err != nil {
 		return err
 	}
 
-	ips, err := getIPs(ctx, eniMAC)
-	if err != nil {
-		return err
-	}
-	eniPrimaryIP := ips[0] // Reserve 'primary' (first) IP address for hostns
-
 	ipn := &net.IPNet{
 		IP:   eniPrimaryIP,
 		Mask: subnet.Mask,
@@ -387,6 +751,12 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 			return err
 		}
 	}
+	// As does hairpinned pod traffic
+	if ipVersion == 4 && state.Hairpin {
+		if err := procSys.Set(fmt.Sprintf("net/ipv4/conf/%s/rp_filter", eniIface.Name), "2"); err != nil {
+			return err
+		}
+	}
 
 	var gwIP net.IP
 	switch ipVersion {
@@ -398,9 +768,7 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 
 	case 6:
 		// Router address isn't given in IMDS, so we
-		// have to wait to observe an RA, and then
-		// copy across from the main route
-		// table. (TODO: yuck!)
+		// have to wait to observe an RA.
 		//
 		// The 'good' news is that this is only slow
 		// the first time per ENI.
@@ -410,27 +778,29 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 			return err
 		}
 
-	routelist:
-		for {
-			routes, err := netlink.RouteListFiltered(family, &netlink.Route{
-				Table:     unix.RT_TABLE_MAIN,
-				LinkIndex: eniLink.Attrs().Index,
-				Dst:       &defaultRoute,
-			}, netlink.RT_FILTER_OIF)
+		cache := newRouterCache(netConf.DataDir)
+		cached, err := cache.Get(eniMAC)
+		if err != nil {
+			return err
+		}
+		gwIP, err = currentRouter6(eniLink)
+		if err != nil {
+			return err
+		}
+		switch {
+		case gwIP == nil && cached != nil:
+			// RA route expired, or not seen since boot
+			gwIP = cached
+		case gwIP == nil:
+			gwIP, err = discoverRouter6(ctx, eniLink, netConf.RouterTimeout.Duration, netConf.RouterSolicitation)
 			if err != nil {
-				return fmt.Errorf("failed to list routes on %s: %v", eniLink.Attrs().Name, err)
+				return err
 			}
-
-			for _, r := range routes {
-				if isDefaultRoute(r.Dst) && !r.Gw.IsUnspecified() {
-					// found a defaultroute!
-					gwIP = r.Gw
-					break routelist
-				}
+		}
+		if !gwIP.Equal(cached) {
+			if err := cache.Put(eniMAC, gwIP); err != nil {
+				return err
 			}
-
-			log.Printf("Waiting for IPv6 router advertisement")
-			time.Sleep(1 * time.Second) // RAs happen every ~10s
 		}
 	}
 
@@ -459,9 +829,13 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 		}
 	}
 
+	if err := setupEniRouteMTUs(netConf, eniLink, ipVersion, tableIdx, gwIP); err != nil {
+		return err
+	}
+
 	// Force ENI 'primary' IP out desired ENI
 	rule = netlink.NewRule()
-	rule.Priority = rulePriorityOutgoingENI
+	rule.Priority = netConf.Routing.PriorityOutgoingENI
 	rule.Table = tableIdx
 	rule.Src = &net.IPNet{
 		IP:   eniPrimaryIP,
@@ -474,19 +848,112 @@ func setupHostEniIface(ec2Metadata metadata.EC2MetadataIface, procSys procsys.Pr
 		}
 	}
 
-	return nil
+	return markers.Put(eniMAC, state)
 }
 
-// Setup pod IP policy routes. Traffic from pod IP has to go out the
-// correct ENI to satisfy the AWS src/dst check.
-func setupHostEniPodRoute(ec2Metadata metadata.EC2MetadataIface, vethName string, eniMAC string, ipc *cniv1.IPConfig) error {
-	ctx := context.TODO()
+// verifyHostEniIface is a cheap (netlink only) check that a
+// previously configured ENI is still configured.  See
+// checkHostEniIface for a thorough check.
+func verifyHostEniIface(eniLink netlink.Link, mtu int, rc RoutingConf, family int, eniPrimaryIP net.IP, tableIdx int) error {
+	attrs := eniLink.Attrs()
+	if mtu != 0 && attrs.MTU != mtu {
+		return fmt.Errorf("MTU is %d, expected %d", attrs.MTU, mtu)
+	}
+	if attrs.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("link %s is down", attrs.Name)
+	}
 
-	imds := metadata.NewTypedIMDS(ec2Metadata)
+	_, maskLen := familyMaskLen(eniPrimaryIP)
 
-	maskLen := 128
-	if ipc.Address.IP.To4() != nil {
-		maskLen = 32
+	for _, rule := range []*netlink.Rule{
+		{
+			Priority: rc.PriorityLocalPods,
+			Table:    rc.TablePod,
+		},
+		{
+			Priority: rc.PriorityMasq,
+			Mark:     masqMark,
+			Table:    unix.RT_TABLE_MAIN,
+		},
+		{
+			Priority: rc.PriorityOutgoingENI,
+			Table:    tableIdx,
+			Src: &net.IPNet{
+				IP:   eniPrimaryIP,
+				Mask: net.CIDRMask(maskLen, maskLen),
+			},
+		},
+	} {
+		if ok, err := findRule(family, rule); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("rule (priority %d, table %d) missing", rule.Priority, rule.Table)
+		}
+	}
+
+	route := netlink.Route{
+		Table:     tableIdx,
+		LinkIndex: attrs.Index,
+		Dst: &net.IPNet{
+			IP:   make(net.IP, maskLen/8),
+			Mask: net.CIDRMask(0, maskLen),
+		},
+	}
+	if ok, err := findRoute(family, route); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("default route missing from table %d", tableIdx)
+	}
+
+	return nil
+}
+
+// verifyHostEniNode is a cheap check of the node-wide state that
+// setupHostEniIface also configures: nodeport marking, rp_filter and
+// external SNAT.  Other software (eg: a firewall reload) can remove
+// these without touching the ENI routing.
+func verifyHostEniNode(procSys procsys.ProcSys, netConf *NetConf, state eniState, snat bool, eniPrimaryIP net.IP) error {
+	fw, err := newNodeportFirewall(state.Firewall, state.IPVersion)
+	if err != nil {
+		return err
+	}
+	if err := fw.CheckPrimary(state.PrimaryIface); err != nil {
+		return err
+	}
+
+	if state.IPVersion == 4 {
+		ifaces := []string{state.PrimaryIface}
+		if state.Hairpin {
+			ifaces = append(ifaces, state.Iface)
+		}
+		for _, iface := range ifaces {
+			key := fmt.Sprintf("net/ipv4/conf/%s/rp_filter", iface)
+			val, err := procSys.Get(key)
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(val) != "2" {
+				return fmt.Errorf("%s is %q, expected \"2\"", key, strings.TrimSpace(val))
+			}
+		}
+	}
+
+	if snat {
+		return checkExternalSNAT(fw, netConf, state.PrimaryIface, eniPrimaryIP)
+	}
+	return nil
+}
+
+// Setup pod IP policy routes.
+func setupHostEniPodRoute(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, vethName string, eniMAC string, ipc *cniv1.IPConfig, tx *undoList) error {
+	maskLen := 128
+	if ipc.Address.IP.To4() != nil {
+		maskLen = 32
+	}
+
+	ipVersion := 6
+	if ipc.Address.IP.To4() != nil {
+		ipVersion = 4
 	}
 
 	veth, err := netlink.LinkByName(vethName)
@@ -494,9 +961,33 @@ func setupHostEniPodRoute(ec2Metadata metadata.EC2MetadataIface, vethName string
 		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
 	}
 
+	fw, err := newNodeportFirewall(netConf.Firewall, ipVersion)
+	if err != nil {
+		return err
+	}
+	err = tx.Do("setup pod firewall", func() error {
+		return fw.SetupPod(vethName)
+	}, func() error {
+		if netConf.Mode == modeChained {
+			// The host interface may be a bridge, still
+			// in use by other pods
+			inUse, err := chainedLinkInUse(netConf.Routing, veth.Attrs().Index, ipVersion)
+			if err != nil {
+				return err
+			}
+			if inUse {
+				return nil
+			}
+		}
+		return fw.TeardownPod(vethName)
+	})
+	if err != nil {
+		return err
+	}
+
 	// per-pod local pod route
 	route := netlink.Route{
-		Table:     routeTablePod,
+		Table:     netConf.Routing.TablePod,
 		LinkIndex: veth.Attrs().Index,
 		Dst: &net.IPNet{
 			IP:   ipc.Address.IP,
@@ -505,50 +996,131 @@ func setupHostEniPodRoute(ec2Metadata metadata.EC2MetadataIface, vethName string
 		Scope: netlink.SCOPE_UNIVERSE,
 		// TODO: Src: primaryIP?
 	}
-	if err := netlink.RouteReplace(&route); err != nil {
-		if !os.IsExist(err) {
-			return fmt.Errorf("failed to add route (%s): %v", route, err)
+	err = tx.Do("add pod route", func() error {
+		if err := netlink.RouteReplace(&route); err != nil {
+			if !os.IsExist(err) {
+				return fmt.Errorf("failed to add route (%s): %v", route, err)
+			}
+		}
+		return nil
+	}, func() error {
+		// Not removed along with the host interface in
+		// chained mode
+		if err := netlink.RouteDel(&route); err != nil {
+			if !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("failed to delete route (%s): %v", route, err)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	deviceNumber, err := imds.GetDeviceNumber(ctx, eniMAC)
-	if err != nil {
+	if err := setupHostEniPodRule(ec2Metadata, netConf, eniMAC, ipc, tx); err != nil {
 		return err
 	}
 
-	tableIdx := routeTableENIStart + deviceNumber
+	return setupHostEniPodHairpin(ec2Metadata, netConf, veth, eniMAC, ipc, tx)
+}
+
+// Setup pod IP policy rule. Traffic from pod IP has to go out the
+// correct ENI to satisfy the AWS src/dst check.
+func setupHostEniPodRule(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, eniMAC string, ipc *cniv1.IPConfig, tx *undoList) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	_, maskLen := familyMaskLen(ipc.Address.IP)
+
+	tableIdx, err := eniRouteTable(ctx, imds, netConf.Routing, eniMAC)
+	if err != nil {
+		return err
+	}
 
 	// Force pod IP out desired ENI
 	rule := netlink.NewRule()
-	rule.Priority = rulePriorityOutgoingENI
+	rule.Priority = netConf.Routing.PriorityOutgoingENI
 	rule.Table = tableIdx
 	rule.Src = &net.IPNet{
 		IP:   ipc.Address.IP,
 		Mask: net.CIDRMask(maskLen, maskLen),
 	}
-	if err := netlink.RuleAdd(rule); err != nil {
-		if !os.IsExist(err) {
-			return fmt.Errorf("failed to add rule (%s): %v", rule, err)
+	err = tx.Do("add pod rule", func() error {
+		if err := netlink.RuleAdd(rule); err != nil {
+			if !os.IsExist(err) {
+				return fmt.Errorf("failed to add rule (%s): %v", rule, err)
+			}
 		}
+		return nil
+	}, func() error {
+		return teardownHostEniPodRoute(netConf.Routing, ipc.Address.IP)
+	})
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func setupHostEni(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, mtu int, vethName string, result *cniv1.Result) error {
+// Remove pod IP policy routes added by setupHostEniPodRoute.  Does
+// not require IMDS or the host veth, since either may already be
+// gone.
+func teardownHostEniPodRoute(rc RoutingConf, podIP net.IP) error {
+	family := unix.AF_INET6
+	maskLen := 128
+	if podIP.To4() != nil {
+		family = unix.AF_INET
+		maskLen = 32
+	}
+	dst := &net.IPNet{
+		IP:   podIP,
+		Mask: net.CIDRMask(maskLen, maskLen),
+	}
+
+	// per-pod local pod route.  Usually already removed along
+	// with the veth.
+	route := netlink.Route{
+		Table: rc.TablePod,
+		Dst:   dst,
+		Scope: netlink.SCOPE_UNIVERSE,
+	}
+	if err := netlink.RouteDel(&route); err != nil {
+		if !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("failed to delete route (%s): %v", route, err)
+		}
+	}
+
+	// Match on priority+src only, since the ENI (and hence table)
+	// may have changed since ADD.
+	filter := netlink.NewRule()
+	filter.Priority = rc.PriorityOutgoingENI
+	filter.Src = dst
+	rules, err := netlink.RuleListFiltered(family, filter, netlink.RT_FILTER_PRIORITY|netlink.RT_FILTER_SRC)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if err := netlink.RuleDel(rule); err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete rule (%s): %v", rule, err)
+			}
+		}
+	}
+
+	return teardownHostEniPodHairpin(rc, podIP)
+}
+
+func setupHostEni(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, vethName string, result *cniv1.Result, tx *undoList) error {
 	ctx := context.TODO()
 
 	imds := metadata.NewTypedIMDS(ec2Metadata)
 
-	ifaces, err := net.Interfaces()
+	interfaceByMAC, err := interfacesByMAC()
 	if err != nil {
 		return err
 	}
-	interfaceByMAC := make(map[string]*net.Interface, len(ifaces))
-	for i := range ifaces {
-		iface := ifaces[i]
-		interfaceByMAC[iface.HardwareAddr.String()] = &iface
-	}
 
 	primaryMAC, err := imds.GetMAC(ctx)
 	if err != nil {
@@ -561,49 +1133,39 @@ func setupHostEni(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys
 
 	for _, ipc := range result.IPs {
 
-		getIPs := imds.GetIPv6s
 		ipVersion := 6
 		if ipc.Address.IP.To4() != nil {
-			getIPs = imds.GetLocalIPv4s
 			ipVersion = 4
 		}
 
-		// Find related ENI
-		macs, err := imds.GetMACs(ctx)
+		eniMAC, err := findEniMAC(ctx, imds, ipc.Address.IP)
 		if err != nil {
 			return err
 		}
-
-		var eniMAC string
-	macloop:
-		for _, mac := range macs {
-			ips, err := getIPs(ctx, mac)
-			if err != nil {
-				return err
-			}
-
-			for _, ip := range ips {
-				if ip.Equal(ipc.Address.IP) {
-					eniMAC = mac
-					break macloop
-				}
-			}
-		}
-		if eniMAC == "" {
-			return fmt.Errorf("failed to find ENI for %s", ipc.Address)
+		if err := checkEniAllowed(ctx, imds, netConf, eniMAC); err != nil {
+			return err
 		}
 
-		if err := setupHostEniIface(ec2Metadata, procSys, mtu, vethName, eniMAC, ipVersion); err != nil {
+		// NB: Per-ENI setup is shared with other pods, so
+		// is never undone.
+		err = tx.Do("setup ENI "+eniMAC, func() error {
+			return setupHostEniIface(ec2Metadata, procSys, netConf, eniMAC, ipVersion)
+		}, nil)
+		if err != nil {
 			return err
 		}
 
-		if err := setupHostEniPodRoute(ec2Metadata, vethName, eniMAC, ipc); err != nil {
+		if err := setupHostEniPodRoute(ec2Metadata, netConf, vethName, eniMAC, ipc, tx); err != nil {
 			return err
 		}
 
-		// Always configure primary ENI (for kubelet itself)
-		if eniMAC != primaryMAC {
-			if err := setupHostEniIface(ec2Metadata, procSys, mtu, vethName, primaryMAC, ipVersion); err != nil {
+		// Always configure primary ENI (for kubelet itself),
+		// unless that's another network's job
+		if eniMAC != primaryMAC && !netConf.Secondary {
+			err = tx.Do("setup ENI "+primaryMAC, func() error {
+				return setupHostEniIface(ec2Metadata, procSys, netConf, primaryMAC, ipVersion)
+			}, nil)
+			if err != nil {
 				return err
 			}
 		}
@@ -613,21 +1175,50 @@ func setupHostEni(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys
 }
 
 func main() {
-	log.SetFlags(0)
-	log.SetPrefix("CNI imds-ptp: ")
-	log.SetOutput(os.Stderr) // NB: ends up in kubelet syslog
+	logging.Init(pluginName)
+
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		if err := repair(os.Args[2:]); err != nil {
+			log.Fatalf("repair failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "policer-stats" {
+		if err := policerStatsCmd(os.Args[2:]); err != nil {
+			log.Fatalf("policer-stats failed: %v", err)
+		}
+		return
+	}
 
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, cniversion.All, fmt.Sprintf("imds-ptp CNI plugin %s", version))
 }
 
+// newEC2Metadata returns the IMDS client (or ENI file) for netConf.
+// A variable so tests can substitute a metadata.FakeIMDS.
+var newEC2Metadata = func(netConf *NetConf) (metadata.EC2MetadataIface, error) {
+	awsConfig := aws.NewConfig().
+		// Lots of retries: we have no better strategy available
+		WithMaxRetries(20)
+
+	return netConf.Source.New(awsConfig)
+}
+
 func cmdCheck(args *skel.CmdArgs) error {
 	netConf, err := loadConf(args.StdinData)
 	if err != nil {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
-	if trace {
-		log.Printf("CHECK: %v", args)
+	done, err := logging.Setup(pluginName, netConf.Conf, "CHECK", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	slog.Debug("CHECK", "config", string(args.StdinData))
+
+	if err := resolveFirewall(netConf); err != nil {
+		return err
 	}
 
 	netns, err := ns.GetNS(args.Netns)
@@ -636,6 +1227,16 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
+	if netConf.Mode == modeChained {
+		// IPAM and the pod interface belong to the main
+		// plugin
+		result, err := chainedPrevResult(netConf)
+		if err != nil {
+			return err
+		}
+		return checkChained(netConf, result)
+	}
+
 	// run the IPAM plugin and get back the config to apply
 	err = ipam.ExecCheck(netConf.IPAM.Type, args.StdinData)
 	if err != nil {
@@ -653,7 +1254,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
-	var contMap cniv1.Interface
+	var contMap, hostMap cniv1.Interface
 	// Find interfaces for name we know, that of host-device inside container
 	for _, intf := range result.Interfaces {
 		if args.IfName == intf.Name {
@@ -662,6 +1263,9 @@ func cmdCheck(args *skel.CmdArgs) error {
 				continue
 			}
 		}
+		if intf.Sandbox == "" {
+			hostMap = *intf
+		}
 	}
 
 	// The namespace must be the same as what was configured
@@ -675,7 +1279,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 	if err := netns.Do(func(_ ns.NetNS) error {
 
 		// Check interface against values found in the container
-		err := validateCniContainerInterface(contMap)
+		err := validateCniContainerInterface(contMap, netConf.Mode)
 		if err != nil {
 			return err
 		}
@@ -689,49 +1293,141 @@ func cmdCheck(args *skel.CmdArgs) error {
 		if err != nil {
 			return err
 		}
+
+		if netConf.Mode != modeIPVlan {
+			return checkContainerAddrs6(args.IfName, result)
+		}
 		return nil
 	}); err != nil {
 		return err
 	}
 
+	// Check host-side state
+	ec2Metadata, err := newEC2Metadata(netConf)
+	if err != nil {
+		return err
+	}
+
+	procSys := procsys.NewProcSys()
+
+	if netConf.Mode == modeIPVlan {
+		// No host interface
+		return checkIPVlanHost(ec2Metadata, procSys, netConf, result)
+	}
+
+	if hostMap.Name == "" {
+		return fmt.Errorf("host interface missing in prevResult")
+	}
+
+	if err := checkHostVeth(hostMap.Name, result); err != nil {
+		return err
+	}
+
+	var podIPs []net.IP
+	for _, ipc := range result.IPs {
+		podIPs = append(podIPs, ipc.Address.IP)
+	}
+	if err := checkAntiSpoof(procSys, netConf, hostMap.Name, podIPs); err != nil {
+		return err
+	}
+
+	egressLimit, err := podEgressLimit(netConf)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicer(hostMap.Name, egressLimit); err != nil {
+		return err
+	}
+
+	if err := checkHostEni(ec2Metadata, procSys, netConf, hostMap.Name, result); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
+	return cmdAddTx(args, &undoList{})
+}
+
+// cmdAddTx is cmdAdd, recording each change in tx.
+func cmdAddTx(args *skel.CmdArgs, tx *undoList) (err error) {
 	netConf, err := loadConf(args.StdinData)
 	if err != nil {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
-	if trace {
-		log.Printf("ADD: %v", args)
+	done, err := logging.Setup(pluginName, netConf.Conf, "ADD", args)
+	if err != nil {
+		return err
 	}
+	defer done()
+
+	slog.Debug("ADD", "config", string(args.StdinData))
 
-	session, err := session.NewSession()
+	if err := resolveFirewall(netConf); err != nil {
+		return err
+	}
+
+	if netConf.Mode == modeChained {
+		return cmdAddChained(args, netConf, tx)
+	}
+
+	contMAC, err := containerMAC(netConf, args.Args)
 	if err != nil {
 		return err
 	}
-	awsConfig := aws.NewConfig().
-		// Lots of retries: we have no better strategy available
-		WithMaxRetries(20)
+	if contMAC != "" && netConf.Mode == modeIPVlan {
+		return fmt.Errorf("mac is not supported with ipvlan: all pods share the ENI MAC")
+	}
+
+	egressLimit, err := podEgressLimit(netConf)
+	if err != nil {
+		return err
+	}
+	if !egressLimit.IsZero() && netConf.Mode == modeIPVlan {
+		return fmt.Errorf("egress limits are not supported with ipvlan: there is no host veth")
+	}
 
-	ec2Metadata := metadata.NewCachedIMDS(ec2metadata.New(session, awsConfig))
+	ec2Metadata, err := newEC2Metadata(netConf)
+	if err != nil {
+		return err
+	}
 
 	procSys := procsys.NewProcSys()
 
-	// run the IPAM plugin and get back the config to apply
-	r, err := ipam.ExecAdd(netConf.IPAM.Type, args.StdinData)
-	if err != nil {
+	if err := migrateRouting(netConf.DataDir, netConf.Routing); err != nil {
 		return err
 	}
 
-	// Invoke ipam del if err to avoid ip leak
+	// NB: Opened before tx, so still open during rollback
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// Revert everything on any failure, including IPAM to avoid
+	// ip leak.  NB: err is the named return value.
 	defer func() {
 		if err != nil {
-			_ = ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+			tx.Rollback()
 		}
 	}()
 
+	// run the IPAM plugin and get back the config to apply
+	var r types.Result
+	err = tx.Do("ipam add", func() error {
+		var err error
+		r, err = ipam.ExecAdd(netConf.IPAM.Type, args.StdinData)
+		return err
+	}, func() error {
+		return ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+	})
+	if err != nil {
+		return err
+	}
+
 	result, err := cniv1.NewResultFromResult(r)
 	if err != nil {
 		return err
@@ -741,36 +1437,92 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("IPAM plugin returned missing IP config")
 	}
 
+	if netConf.Secondary {
+		dropDefaultRoutes(result)
+	}
+
 	if err := ip.EnableForward(result.IPs); err != nil {
 		return fmt.Errorf("could not enable IP forwarding: %v", err)
 	}
 
-	netns, err := ns.GetNS(args.Netns)
-	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	var hostVethName string
+	if netConf.Mode != modeIPVlan {
+		hostVethName, err = pickHostVethName(netConf.VethPrefix, args.ContainerID, args.IfName)
+		if err != nil {
+			return err
+		}
 	}
-	defer netns.Close()
 
-	hostInterface, _, err := setupContainerVeth(netns, args.IfName, netConf.MTU, result)
+	// For DEL, in case there is no prevResult or netns by then
+	records := newPodRecords(netConf.DataDir)
+	rec := podRecord{VethName: hostVethName}
+	for _, ipc := range result.IPs {
+		rec.IPs = append(rec.IPs, ipc.Address.IP.String())
+	}
+	err = tx.Do("record pod", func() error {
+		return records.Put(args.ContainerID, args.IfName, rec)
+	}, func() error {
+		return records.Delete(args.ContainerID, args.IfName)
+	})
 	if err != nil {
 		return err
 	}
 
-	if err = setupHostVeth(hostInterface.Name, result); err != nil {
-		return err
-	}
+	switch netConf.Mode {
+	case modeIPVlan:
+		if _, err = setupIPVlan(ec2Metadata, procSys, netConf, netns, args.IfName, result, tx); err != nil {
+			return err
+		}
 
-	if err = setupHostEni(ec2Metadata, procSys, netConf.MTU, hostInterface.Name, result); err != nil {
-		return err
+	default:
+		var mtu int
+		mtu, err = podMTU(ec2Metadata, netConf, result)
+		if err != nil {
+			return err
+		}
+
+		var hostInterface *cniv1.Interface
+		hostInterface, _, err = setupContainerVeth(netns, args.IfName, hostVethName, contMAC, mtu, netConf.RouteMTUs, result, tx)
+		if err != nil {
+			return err
+		}
+
+		if err = setupHostVeth(hostInterface.Name, result, tx); err != nil {
+			return err
+		}
+
+		var podIPs []net.IP
+		for _, ipc := range result.IPs {
+			podIPs = append(podIPs, ipc.Address.IP)
+		}
+		vethName := hostInterface.Name
+		err = tx.Do("setup anti-spoofing", func() error {
+			return setupAntiSpoof(procSys, netConf, vethName, podIPs)
+		}, func() error {
+			return teardownAntiSpoof(netConf, vethName)
+		})
+		if err != nil {
+			return err
+		}
+
+		// Removed along with the veth
+		err = tx.Do("setup egress policer", func() error {
+			return setupPolicer(vethName, egressLimit)
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		if err = setupHostEni(ec2Metadata, procSys, netConf, hostInterface.Name, result, tx); err != nil {
+			return err
+		}
 	}
 
 	if dnsConfSet(netConf.DNS) {
 		result.DNS = netConf.DNS
 	}
 
-	if trace {
-		log.Printf("ADD returning %v", result)
-	}
+	slog.Debug("ADD returning", "result", result)
 
 	return types.PrintResult(result, netConf.CNIVersion)
 }
@@ -788,41 +1540,154 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to parse config: %v", err)
 	}
 
-	if trace {
-		log.Printf("DEL: %v", args)
+	done, err := logging.Setup(pluginName, netConf.Conf, "DEL", args)
+	if err != nil {
+		return err
 	}
+	defer done()
 
-	if err := ipam.ExecDel(netConf.IPAM.Type, args.StdinData); err != nil {
+	slog.Debug("DEL", "config", string(args.StdinData))
+
+	if err := resolveFirewall(netConf); err != nil {
 		return err
 	}
 
-	if args.Netns == "" {
-		return nil
+	if netConf.Mode == modeChained {
+		return cmdDelChained(args, netConf)
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		var err error
-		_, err = ip.DelLinkByNameAddr(args.IfName)
-		if err != nil && err == ip.ErrLinkNotFound {
-			return nil
+	// Pod IPs, from prevResult and/or the container interface.
+	// Either may be missing, if the netns is already gone or the
+	// runtime is too old to send prevResult.
+	var podIPs []net.IP
+	var vethName string
+	if netConf.RawPrevResult != nil {
+		if err := cniversion.ParsePrevResult(&netConf.NetConf); err != nil {
+			return err
 		}
-		return err
-	})
+		prevResult, err := cniv1.NewResultFromResult(netConf.PrevResult)
+		if err != nil {
+			return err
+		}
+		for _, ipc := range prevResult.IPs {
+			podIPs = append(podIPs, ipc.Address.IP)
+		}
+		for _, intf := range prevResult.Interfaces {
+			if intf.Sandbox == "" {
+				vethName = intf.Name
+			}
+		}
+	}
 
+	// Recorded by ADD, for when both are missing
+	records := newPodRecords(netConf.DataDir)
+	rec, err := records.Get(args.ContainerID, args.IfName)
 	if err != nil {
 		return err
 	}
+	if rec != nil {
+		for _, s := range rec.IPs {
+			if ip := net.ParseIP(s); ip != nil {
+				podIPs = append(podIPs, ip)
+			}
+		}
+		if vethName == "" {
+			vethName = rec.VethName
+		}
+	}
 
-	if trace {
-		log.Printf("DEL returning success")
+	if vethName != "" {
+		logPolicerStats(vethName)
 	}
 
+	if args.Netns != "" {
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device is already removed.
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			ipnets, err := ip.DelLinkByNameAddr(args.IfName)
+			if err != nil && err == ip.ErrLinkNotFound {
+				return nil
+			}
+			for _, ipn := range ipnets {
+				podIPs = append(podIPs, ipn.IP)
+			}
+			return err
+		})
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return err
+			}
+		}
+	}
+
+	// Make sure we're removing rules from the right place
+	if err := migrateRouting(netConf.DataDir, netConf.Routing); err != nil {
+		return err
+	}
+
+	// NB: Remove host state before releasing the IPs, so we can't
+	// race with a new pod that reuses the same IP.
+	seen := make(map[string]bool, len(podIPs))
+	for _, podIP := range podIPs {
+		if seen[podIP.String()] {
+			continue
+		}
+		seen[podIP.String()] = true
+
+		if err := teardownHostEniPodRoute(netConf.Routing, podIP); err != nil {
+			return err
+		}
+
+		// After the routes are gone, so no new flows can appear.
+		// Stale flows are no reason to fail (and retry) DEL.
+		if err := flushConntrack(podIP); err != nil {
+			log.Printf("Failed to flush conntrack: %v", err)
+		}
+	}
+
+	if netConf.Mode != modeIPVlan {
+		if vethName == "" {
+			// No prevResult or record, and the netns (and
+			// so the veth) is gone.  The veth almost
+			// certainly had the first name that is now
+			// unused.
+			vethName, err = pickHostVethName(netConf.VethPrefix, args.ContainerID, args.IfName)
+			if err != nil {
+				return err
+			}
+		}
+		versions := antiSpoofVersions(podIPs)
+		if len(versions) == 0 {
+			versions = []int{4, 6}
+		}
+		for _, ipVersion := range versions {
+			fw, err := newNodeportFirewall(netConf.Firewall, ipVersion)
+			if err != nil {
+				return err
+			}
+			if err := fw.TeardownPod(vethName); err != nil {
+				return err
+			}
+		}
+		if err := teardownAntiSpoof(netConf, vethName); err != nil {
+			return err
+		}
+	}
+
+	if err := ipam.ExecDel(netConf.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+
+	if err := records.Delete(args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	slog.Debug("DEL returning success")
+
 	return nil
 }
 
-func validateCniContainerInterface(intf cniv1.Interface) error {
+func validateCniContainerInterface(intf cniv1.Interface, mode string) error {
 
 	var link netlink.Link
 	var err error
@@ -838,9 +1703,16 @@ func validateCniContainerInterface(intf cniv1.Interface) error {
 		return fmt.Errorf("ptp: Error: Container interface %s should not be in host namespace", link.Attrs().Name)
 	}
 
-	_, isVeth := link.(*netlink.Veth)
-	if !isVeth {
-		return fmt.Errorf("container interface %s not of type veth/p2p", link.Attrs().Name)
+	switch mode {
+	case modeIPVlan:
+		if _, ok := link.(*netlink.IPVlan); !ok {
+			return fmt.Errorf("container interface %s not of type ipvlan", link.Attrs().Name)
+		}
+	default:
+		_, isVeth := link.(*netlink.Veth)
+		if !isVeth {
+			return fmt.Errorf("container interface %s not of type veth/p2p", link.Attrs().Name)
+		}
 	}
 
 	if intf.Mac != "" {
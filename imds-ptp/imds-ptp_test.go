@@ -0,0 +1,200 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+func TestLoadConfMode(t *testing.T) {
+	n, err := loadConf([]byte(`{"firewall": "nftables"}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, modePtp, n.Mode)
+		assert.Equal(t, ipvlanModeL3, n.IPVlanMode)
+	}
+
+	n, err = loadConf([]byte(`{"firewall": "nftables", "mode": "ipvlan", "ipvlanMode": "l3s"}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, modeIPVlan, n.Mode)
+		assert.Equal(t, ipvlanModeL3S, n.IPVlanMode)
+	}
+
+	_, err = loadConf([]byte(`{"firewall": "nftables", "mode": "macvlan"}`))
+	assert.Error(t, err)
+
+	_, err = loadConf([]byte(`{"firewall": "nftables", "mode": "ipvlan", "ipvlanMode": "l2"}`))
+	assert.Error(t, err)
+}
+
+func TestExternalSNATExclusions(t *testing.T) {
+	imds := metadata.NewTypedIMDS(metadata.FakeIMDS(map[string]interface{}{
+		"network/interfaces/macs/02:00:00:00:00:01/vpc-ipv4-cidr-blocks": "10.0.0.0/16\n100.64.0.0/16",
+	}))
+
+	netConf, err := loadConf([]byte(`{"firewall": "nftables", "externalSNAT": true, "excludeSNATCIDRs": ["192.168.1.7/24", "fd00::/8"]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	exclude, err := externalSNATExclusions(context.TODO(), imds, netConf, "02:00:00:00:00:01")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"10.0.0.0/16", "100.64.0.0/16", "192.168.1.0/24"}, cidrStrings(exclude))
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	imds := metadata.NewTypedIMDS(metadata.FakeIMDS(map[string]interface{}{
+		"network/interfaces/macs/02:00:00:00:00:01/interface-id": "eni-0001",
+		"network/interfaces/macs/02:00:00:00:00:02/interface-id": "eni-0002",
+	}))
+
+	netConf, err := loadConf([]byte(`{"firewall": "nftables", "secondary": true, "enis": ["eni-0002", "02:00:00:00:00:03"]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Error(t, checkEniAllowed(context.TODO(), imds, netConf, "02:00:00:00:00:01"))
+	assert.NoError(t, checkEniAllowed(context.TODO(), imds, netConf, "02:00:00:00:00:02"), "by ID")
+	assert.NoError(t, checkEniAllowed(context.TODO(), imds, netConf, "02:00:00:00:00:03"), "by MAC")
+
+	netConf.ENIs = nil
+	assert.NoError(t, checkEniAllowed(context.TODO(), imds, netConf, "02:00:00:00:00:01"), "unrestricted")
+
+	result := &cniv1.Result{
+		Routes: []*types.Route{
+			{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}},
+			{Dst: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}},
+			{Dst: net.IPNet{IP: net.ParseIP("10.1.0.0"), Mask: net.CIDRMask(16, 32)}},
+		},
+	}
+	dropDefaultRoutes(result)
+	if assert.Len(t, result.Routes, 1) {
+		assert.Equal(t, "10.1.0.0/16", result.Routes[0].Dst.String())
+	}
+}
+
+func TestFindEniMACMixedFamilies(t *testing.T) {
+	// Single-family ENIs, each listed before the other family's
+	imds := metadata.NewTypedIMDS(metadata.FakeIMDS(map[string]interface{}{
+		"network/interfaces/macs": "02:00:00:00:00:01/\n02:00:00:00:00:02/\n02:00:00:00:00:03/",
+
+		"network/interfaces/macs/02:00:00:00:00:01/ipv6s":       "2001:db8:1::4",
+		"network/interfaces/macs/02:00:00:00:00:02/local-ipv4s": "10.0.2.4\n10.0.2.5",
+		"network/interfaces/macs/02:00:00:00:00:03/ipv6s":       "2001:db8:3::4\n2001:db8:3::5",
+	}))
+
+	mac, err := findEniMAC(context.TODO(), imds, net.ParseIP("10.0.2.5"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "02:00:00:00:00:02", mac)
+	}
+
+	mac, err = findEniMAC(context.TODO(), imds, net.ParseIP("2001:db8:3::5"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "02:00:00:00:00:03", mac)
+	}
+
+	_, err = findEniMAC(context.TODO(), imds, net.ParseIP("10.0.9.9"))
+	assert.Error(t, err)
+}
+
+func TestSetupVethIPv6(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	hostNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(hostNS)
+	defer hostNS.Close()
+
+	podNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(podNS)
+	defer podNS.Close()
+
+	podIP := net.ParseIP("2001:db8::5")
+	result := &cniv1.Result{
+		IPs: []*cniv1.IPConfig{{
+			Address: net.IPNet{IP: podIP, Mask: net.CIDRMask(64, 128)},
+			Gateway: net.ParseIP("fe80::1"),
+		}},
+	}
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		// As in cmdAdd
+		require.NoError(t, ip.EnableForward(result.IPs))
+
+		tx := &undoList{}
+		start := time.Now()
+		hostIface, contIface, err := setupContainerVeth(podNS, "eth0", "veth0", "", 1500, nil, result, tx)
+		require.NoError(t, err)
+		require.NoError(t, setupHostVeth(hostIface.Name, result, tx))
+		assert.Less(t, time.Since(start), time.Second, "waited for DAD")
+
+		assert.NoError(t, checkHostVeth("veth0", result))
+
+		// The unsolicited NA added a neighbour entry.  Not
+		// assert.Eventually, which polls from another
+		// goroutine (and netns).
+		veth, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+		var neighMAC string
+		for deadline := time.Now().Add(time.Second); neighMAC == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			neighs, err := netlink.NeighList(veth.Attrs().Index, unix.AF_INET6)
+			require.NoError(t, err)
+			for _, n := range neighs {
+				if n.IP.Equal(podIP) {
+					neighMAC = n.HardwareAddr.String()
+				}
+			}
+		}
+		assert.Equal(t, contIface.Mac, neighMAC)
+
+		addrs, err := netlink.AddrList(veth, unix.AF_INET6)
+		require.NoError(t, err)
+		for _, a := range addrs {
+			if a.IP.Equal(result.IPs[0].Gateway) {
+				require.NoError(t, netlink.AddrDel(veth, &a))
+				a.Flags = 0
+				a.Scope = int(netlink.SCOPE_UNIVERSE)
+				require.NoError(t, netlink.AddrAdd(veth, &a))
+			}
+		}
+		assert.Error(t, checkHostVeth("veth0", result), "tentative or wrong scope")
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = podNS.Do(func(ns.NetNS) error {
+		assert.NoError(t, checkContainerAddrs6("eth0", result))
+		return nil
+	})
+	require.NoError(t, err)
+}
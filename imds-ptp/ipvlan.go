@@ -0,0 +1,297 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+// In "ipvlan" mode, instead of a veth pair plus host routes, the pod
+// gets an ipvlan L3 (or L3S) slave of the ENI that owns its IP.  Pod
+// traffic goes straight to/from the ENI, without passing through the
+// host routing table.
+//
+// What still happens on the host: per-ENI setup (link up, MTU, ENI
+// route table), and the pod source IP policy rule, since ipvlan
+// looks up the outgoing route in the host netns.
+//
+// What is lost:
+//
+//   - The host can't reach its own ipvlan pods (ipvlan doesn't pass
+//     traffic between master and slaves).  So kubelet probes and
+//     hostNetwork pods can't talk to ipvlan pods.
+//
+//   - There is no host veth, so none of the nodeport CONNMARK rules
+//     (see firewall.go) apply.  NodePort/LoadBalancer traffic that
+//     kube-proxy DNATs to an ipvlan pod will not be delivered.
+//
+//   - In "l3" mode, pod traffic skips host netfilter entirely, so
+//     kube-proxy ClusterIP services don't work from ipvlan pods.
+//     "l3s" mode sends pod traffic through host netfilter (and
+//     conntrack), at some cost in latency.
+//
+// Hence this is only suitable for latency-sensitive workloads that
+// talk directly to pod IPs.
+
+const (
+	modePtp    = "ptp"
+	modeIPVlan = "ipvlan"
+
+	ipvlanModeL3  = "l3"
+	ipvlanModeL3S = "l3s"
+)
+
+// ipvlanEniMAC returns the ENI that owns all of result's IPs.
+// There's only one ipvlan parent, so all IPs must be on the same ENI.
+func ipvlanEniMAC(ctx context.Context, imds metadata.TypedIMDS, result *cniv1.Result) (string, error) {
+	var eniMAC string
+	for _, ipc := range result.IPs {
+		mac, err := findEniMAC(ctx, imds, ipc.Address.IP)
+		if err != nil {
+			return "", err
+		}
+		if eniMAC != "" && mac != eniMAC {
+			return "", fmt.Errorf("pod IPs are on different ENIs (%s and %s), which is not supported with ipvlan", eniMAC, mac)
+		}
+		eniMAC = mac
+	}
+	return eniMAC, nil
+}
+
+func setupIPVlan(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, netns ns.NetNS, ifName string, result *cniv1.Result, tx *undoList) (*cniv1.Interface, error) {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	primaryMAC, err := imds.GetMAC(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	eniMAC, err := ipvlanEniMAC(ctx, imds, result)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEniAllowed(ctx, imds, netConf, eniMAC); err != nil {
+		return nil, err
+	}
+
+	for _, ipc := range result.IPs {
+		ipVersion := 6
+		if ipc.Address.IP.To4() != nil {
+			ipVersion = 4
+		}
+
+		// NB: Per-ENI setup is shared with other pods, so
+		// is never undone.
+		err = tx.Do("setup ENI "+eniMAC, func() error {
+			return setupHostEniIface(ec2Metadata, procSys, netConf, eniMAC, ipVersion)
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// Always configure primary ENI (for kubelet itself),
+		// unless that's another network's job
+		if eniMAC != primaryMAC && !netConf.Secondary {
+			err = tx.Do("setup ENI "+primaryMAC, func() error {
+				return setupHostEniIface(ec2Metadata, procSys, netConf, primaryMAC, ipVersion)
+			}, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	interfaceByMAC, err := interfacesByMAC()
+	if err != nil {
+		return nil, err
+	}
+	eniIface, ok := interfaceByMAC[eniMAC]
+	if !ok {
+		return nil, fmt.Errorf("failed to find existing interface with MAC %s", eniMAC)
+	}
+
+	mode := netlink.IPVLAN_MODE_L3
+	if netConf.IPVlanMode == ipvlanModeL3S {
+		mode = netlink.IPVLAN_MODE_L3S
+	}
+
+	// Create with a temporary name, in case ifName already
+	// exists on the host.
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        tmpName,
+			MTU:         netConf.MTU,
+			ParentIndex: eniIface.Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+
+	err = tx.Do("create ipvlan", func() error {
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("failed to create ipvlan: %v", err)
+		}
+		return netns.Do(func(ns.NetNS) error {
+			if err := ip.RenameLink(tmpName, ifName); err != nil {
+				_ = ip.DelLinkByName(tmpName)
+				return fmt.Errorf("failed to rename ipvlan to %q: %v", ifName, err)
+			}
+			return nil
+		})
+	}, func() error {
+		// Also removes all addresses and routes
+		return netns.Do(func(ns.NetNS) error {
+			return ip.DelLinkByName(ifName)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contIface := &cniv1.Interface{
+		Name:    ifName,
+		Sandbox: netns.Path(),
+	}
+
+	err = netns.Do(func(ns.NetNS) error {
+		contLink, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		contIface.Mac = contLink.Attrs().HardwareAddr.String()
+
+		return tx.Do("configure container ipvlan", func() error {
+			return configureIPVlan(contLink, result, netConf.RouteMTUs)
+		}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Interfaces = []*cniv1.Interface{contIface}
+	for _, ipc := range result.IPs {
+		ipc.Interface = cniv1.Int(0)
+	}
+
+	for _, ipc := range result.IPs {
+		if err := setupHostEniPodRule(ec2Metadata, netConf, eniMAC, ipc, tx); err != nil {
+			return nil, err
+		}
+	}
+
+	return contIface, nil
+}
+
+// configureIPVlan adds addresses and routes to the container ipvlan
+// link.  Unlike veth, there is no ARP on an L3 ipvlan, so routes go
+// directly out the link rather than via the gateway.
+func configureIPVlan(link netlink.Link, result *cniv1.Result, routeMTUs []RouteMTU) error {
+	for _, ipc := range result.IPs {
+		addr := &netlink.Addr{IPNet: &ipc.Address}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("failed to add IP addr %s to %s: %v", ipc.Address.String(), link.Attrs().Name, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %s up: %v", link.Attrs().Name, err)
+	}
+
+	for _, r := range result.Routes {
+		dst := r.Dst
+		route := netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &dst,
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteAdd(&route); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", route, err)
+		}
+	}
+
+	// No gateway with ipvlan (l3), so these are dev-only too
+	for _, r := range routeMTUs {
+		if !hasIPVersion(result, r.ipv4()) {
+			continue
+		}
+		route := netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       r.dst(),
+			MTU:       r.MTU,
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteAdd(&route); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", route, err)
+		}
+	}
+
+	return nil
+}
+
+// checkIPVlanHost checks host-side state for an ipvlan pod, as
+// configured by setupIPVlan.
+func checkIPVlanHost(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, result *cniv1.Result) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	primaryMAC, err := imds.GetMAC(ctx)
+	if err != nil {
+		return err
+	}
+
+	eniMAC, err := ipvlanEniMAC(ctx, imds, result)
+	if err != nil {
+		return err
+	}
+
+	for _, ipc := range result.IPs {
+		ipVersion := 6
+		if ipc.Address.IP.To4() != nil {
+			ipVersion = 4
+		}
+
+		if err := checkHostEniIface(ec2Metadata, procSys, netConf, eniMAC, ipVersion); err != nil {
+			return err
+		}
+
+		if err := checkHostEniPodRule(ec2Metadata, netConf, eniMAC, ipc); err != nil {
+			return err
+		}
+
+		if eniMAC != primaryMAC && !netConf.Secondary {
+			if err := checkHostEniIface(ec2Metadata, procSys, netConf, primaryMAC, ipVersion); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+// findLinkByMAC returns the link with the given MAC, or nil.
+func findLinkByMAC(mac string) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if strings.EqualFold(link.Attrs().HardwareAddr.String(), mac) {
+			return link, nil
+		}
+	}
+	return nil, nil
+}
+
+// waitForLinkByMAC returns the link with the given MAC, waiting up
+// to timeout for it to appear.  A just-attached ENI shows up in IMDS
+// before the kernel (and udev) have created the link.
+func waitForLinkByMAC(mac string, timeout time.Duration) (netlink.Link, error) {
+	// Subscribe before listing, so a link that appears in between
+	// isn't missed.
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to link updates: %v", err)
+	}
+
+	link, err := findLinkByMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if link != nil {
+		return link, nil
+	}
+
+	log.Printf("Waiting up to %s for interface with MAC %s", timeout, mac)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				return nil, fmt.Errorf("link subscription closed while waiting for interface with MAC %s", mac)
+			}
+			if u.Header.Type != unix.RTM_NEWLINK {
+				continue
+			}
+			if strings.EqualFold(u.Link.Attrs().HardwareAddr.String(), mac) {
+				return u.Link, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("failed to find existing interface with MAC %s after %s", mac, timeout)
+		}
+	}
+}
+
+// eniLinkName returns the predictable name for an ENI, from its
+// network card and device number.
+func eniLinkName(prefix string, card, deviceNumber int) string {
+	if card == 0 {
+		return fmt.Sprintf("%s%d", prefix, deviceNumber)
+	}
+	return fmt.Sprintf("%s%d-%d", prefix, card, deviceNumber)
+}
+
+// renameEniLink renames a (secondary) ENI link to its predictable
+// name, if netConf.ENINamePrefix is set.  Links that are already up
+// are left alone, since renaming requires taking the link down.
+func renameEniLink(ctx context.Context, imds metadata.TypedIMDS, netConf *NetConf, eniMAC string, link netlink.Link) (netlink.Link, error) {
+	if netConf.ENINamePrefix == "" {
+		return link, nil
+	}
+
+	card, err := imds.GetNetworkCard(ctx, eniMAC)
+	if err != nil {
+		return nil, err
+	}
+	deviceNumber, err := imds.GetDeviceNumber(ctx, eniMAC)
+	if err != nil {
+		return nil, err
+	}
+	name := eniLinkName(netConf.ENINamePrefix, card, deviceNumber)
+
+	if link.Attrs().Name == name {
+		return link, nil
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		slog.Debug("Not renaming ENI: link is up", "link", link.Attrs().Name, "name", name)
+		return link, nil
+	}
+
+	if err := netlink.LinkSetName(link, name); err != nil {
+		// Possibly renamed by a concurrent ADD
+		if l, lerr := netlink.LinkByIndex(link.Attrs().Index); lerr == nil && l.Attrs().Name == name {
+			return l, nil
+		}
+		return nil, fmt.Errorf("failed to rename %s to %s: %v", link.Attrs().Name, name, err)
+	}
+	log.Printf("Renamed ENI %s from %s to %s", eniMAC, link.Attrs().Name, name)
+
+	return netlink.LinkByIndex(link.Attrs().Index)
+}
+
+const (
+	// Leaves at least 8 hex digits of hash
+	maxVethPrefixLen = unix.IFNAMSIZ - 1 - 8
+
+	// Attempts to find an unused host veth name
+	vethNameAttempts = 10
+)
+
+// hostVethName returns the attempt'th candidate host veth name for a
+// container interface.  The same inputs always give the same name,
+// so the name is meaningful in tcpdump, metrics, etc.
+func hostVethName(prefix, containerID, ifName string, attempt int) string {
+	key := containerID + "." + ifName
+	if attempt > 0 {
+		key += "." + strconv.Itoa(attempt)
+	}
+	h := sha1.Sum([]byte(key))
+	return prefix + hex.EncodeToString(h[:])[:unix.IFNAMSIZ-1-len(prefix)]
+}
+
+// pickHostVethName returns the first candidate host veth name that
+// isn't already in use.
+func pickHostVethName(prefix, containerID, ifName string) (string, error) {
+	for i := 0; i < vethNameAttempts; i++ {
+		name := hostVethName(prefix, containerID, ifName, i)
+		_, err := netlink.LinkByName(name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return name, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		log.Printf("Host veth name %s for %s/%s already in use", name, containerID, ifName)
+	}
+	return "", fmt.Errorf("failed to find an unused host veth name for %s/%s", containerID, ifName)
+}
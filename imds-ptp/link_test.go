@@ -0,0 +1,119 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestEniLinkName(t *testing.T) {
+	assert.Equal(t, "eni2", eniLinkName("eni", 0, 2))
+	assert.Equal(t, "eni1-2", eniLinkName("eni", 1, 2))
+
+	_, err := loadConf([]byte(`{"firewall": "nftables", "eniNamePrefix": "waytoolongprefix"}`))
+	assert.Error(t, err)
+}
+
+func TestWaitForLinkByMAC(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	const mac = "02:00:00:00:00:42"
+	hwaddr, err := net.ParseMAC(mac)
+	require.NoError(t, err)
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		_, err := waitForLinkByMAC(mac, 100*time.Millisecond)
+		assert.Error(t, err, "timeout")
+
+		// "Hot-plug" the link while waiting
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			targetNS.Do(func(ns.NetNS) error {
+				la := netlink.NewLinkAttrs()
+				la.Name = "eth1"
+				la.HardwareAddr = hwaddr
+				return netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "eth1p"})
+			})
+		}()
+
+		link, err := waitForLinkByMAC(mac, 10*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "eth1", link.Attrs().Name)
+
+		// Already present
+		link, err = waitForLinkByMAC(mac, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "eth1", link.Attrs().Name)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPickHostVethName(t *testing.T) {
+	name := hostVethName("eni", "abc123", "eth0", 0)
+	assert.Len(t, name, unix.IFNAMSIZ-1)
+	assert.True(t, strings.HasPrefix(name, "eni"))
+	assert.Equal(t, name, hostVethName("eni", "abc123", "eth0", 0), "deterministic")
+	assert.NotEqual(t, name, hostVethName("eni", "abc123", "eth1", 0))
+	assert.NotEqual(t, name, hostVethName("eni", "abc123", "eth0", 1))
+
+	_, err := loadConf([]byte(`{"firewall": "nftables", "vethPrefix": "muchtoolong"}`))
+	assert.Error(t, err)
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		got, err := pickHostVethName("eni", "abc123", "eth0")
+		require.NoError(t, err)
+		assert.Equal(t, name, got)
+
+		// Collision
+		la := netlink.NewLinkAttrs()
+		la.Name = name
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "peer0"}))
+
+		got, err = pickHostVethName("eni", "abc123", "eth0")
+		require.NoError(t, err)
+		assert.Equal(t, hostVethName("eni", "abc123", "eth0", 1), got)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,63 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// macEnvArgs is the MAC= CNI_ARGS key
+type macEnvArgs struct {
+	types.CommonArgs
+	MAC types.UnmarshallableString `json:"mac,omitempty"`
+}
+
+// containerMAC returns the requested container interface MAC, or
+// "" for a random one.  As in the standard bridge plugin, the
+// runtimeConfig "mac" capability wins over "args", which wins over
+// CNI_ARGS.
+func containerMAC(netConf *NetConf, envArgs string) (string, error) {
+	var mac string
+	if envArgs != "" {
+		e := macEnvArgs{}
+		if err := types.LoadArgs(envArgs, &e); err != nil {
+			return "", err
+		}
+		mac = string(e.MAC)
+	}
+	if netConf.Args.Cni.Mac != "" {
+		mac = netConf.Args.Cni.Mac
+	}
+	if netConf.RuntimeConfig.Mac != "" {
+		mac = netConf.RuntimeConfig.Mac
+	}
+	if mac == "" {
+		return "", nil
+	}
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid mac %q: %v", mac, err)
+	}
+	if len(hw) != 6 {
+		return "", fmt.Errorf("invalid mac %q: not an Ethernet MAC", mac)
+	}
+	if hw[0]&1 != 0 {
+		return "", fmt.Errorf("invalid mac %q: multicast", mac)
+	}
+	return hw.String(), nil
+}
@@ -0,0 +1,94 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerMAC(t *testing.T) {
+	conf, err := loadConf([]byte(`{"firewall": "nftables"}`))
+	require.NoError(t, err)
+	mac, err := containerMAC(conf, "")
+	require.NoError(t, err)
+	assert.Empty(t, mac)
+
+	mac, err = containerMAC(conf, "IgnoreUnknown=1;MAC=0A:58:0A:00:00:01")
+	require.NoError(t, err)
+	assert.Equal(t, "0a:58:0a:00:00:01", mac)
+
+	conf, err = loadConf([]byte(`{"firewall": "nftables", "args": {"cni": {"mac": "0a:58:0a:00:00:02"}}}`))
+	require.NoError(t, err)
+	mac, err = containerMAC(conf, "IgnoreUnknown=1;MAC=0a:58:0a:00:00:01")
+	require.NoError(t, err)
+	assert.Equal(t, "0a:58:0a:00:00:02", mac, "args wins over CNI_ARGS")
+
+	conf, err = loadConf([]byte(`{"firewall": "nftables", "args": {"cni": {"mac": "0a:58:0a:00:00:02"}}, "runtimeConfig": {"mac": "0a:58:0a:00:00:03"}}`))
+	require.NoError(t, err)
+	mac, err = containerMAC(conf, "")
+	require.NoError(t, err)
+	assert.Equal(t, "0a:58:0a:00:00:03", mac, "runtimeConfig wins")
+
+	for _, bad := range []string{"nonsense", "01:00:5e:00:00:01", "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"} {
+		conf, err = loadConf([]byte(`{"firewall": "nftables", "runtimeConfig": {"mac": "` + bad + `"}}`))
+		require.NoError(t, err)
+		_, err = containerMAC(conf, "")
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSetupContainerVethMAC(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	const mac = "0a:58:0a:01:02:03"
+	result := &cniv1.Result{
+		IPs: []*cniv1.IPConfig{{
+			Address: net.IPNet{
+				IP:   net.ParseIP("10.1.2.3"),
+				Mask: net.CIDRMask(24, 32),
+			},
+			Gateway: net.ParseIP("10.1.2.1"),
+		}},
+	}
+
+	tx := &undoList{}
+	defer tx.Rollback()
+	_, contIface, err := setupContainerVeth(targetNS, "eth0", "", mac, 1500, nil, result, tx)
+	require.NoError(t, err)
+	assert.Equal(t, mac, contIface.Mac)
+	assert.Equal(t, mac, result.Interfaces[1].Mac)
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		iface, err := net.InterfaceByName("eth0")
+		require.NoError(t, err)
+		assert.Equal(t, mac, iface.HardwareAddr.String())
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,187 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+// Jumbo frames (9001) only work within the VPC.  Traffic to the
+// internet, or across a VPN or Transit Gateway, has a smaller path
+// MTU and relies on PMTU discovery, which breaks when ICMP is
+// filtered somewhere along the way.  RouteMTUs lower the MTU for
+// those destinations up front, in the pod netns and the per-ENI
+// route tables.
+
+// RouteMTU is a destination with its own (smaller) MTU.
+type RouteMTU struct {
+	Dst types.IPNet `json:"dst"`
+	MTU int         `json:"mtu"`
+}
+
+func (r RouteMTU) String() string {
+	dst := net.IPNet(r.Dst)
+	return fmt.Sprintf("%s mtu %d", dst.String(), r.MTU)
+}
+
+// ipv4 returns true if r is an IPv4 destination.
+func (r RouteMTU) ipv4() bool {
+	return r.Dst.IP.To4() != nil && len(r.Dst.Mask) == net.IPv4len
+}
+
+// dst returns r.Dst with any host bits cleared.
+func (r RouteMTU) dst() *net.IPNet {
+	ip := r.Dst.IP
+	if r.ipv4() {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(r.Dst.Mask), Mask: r.Dst.Mask}
+}
+
+func validateRouteMTUs(routeMTUs []RouteMTU) error {
+	for _, r := range routeMTUs {
+		if r.Dst.IP == nil {
+			return errors.New("routeMTUs entry missing dst")
+		}
+		min := 1280 // IPv6 minimum
+		if r.ipv4() {
+			min = 68
+		}
+		if r.MTU < min || r.MTU > 65535 {
+			return fmt.Errorf("routeMTUs %s: mtu out of range (%d-65535)", r, min)
+		}
+	}
+	return nil
+}
+
+// routeMTUsFor returns the RouteMTUs for one IP version.
+func routeMTUsFor(routeMTUs []RouteMTU, ipVersion int) []RouteMTU {
+	var ret []RouteMTU
+	for _, r := range routeMTUs {
+		if r.ipv4() == (ipVersion == 4) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// hasIPVersion returns true if result has an IPv4 (or IPv6) address.
+func hasIPVersion(result *cniv1.Result, ipv4 bool) bool {
+	for _, ipc := range result.IPs {
+		if (ipc.Address.IP.To4() != nil) == ipv4 {
+			return true
+		}
+	}
+	return false
+}
+
+// podMTU returns the MTU for the pod interface: netConf.MTU, or the
+// MTU of the ENI owning the pod's (first) IP.
+func podMTU(ec2Metadata metadata.EC2MetadataIface, netConf *NetConf, result *cniv1.Result) (int, error) {
+	if netConf.MTU != 0 {
+		return netConf.MTU, nil
+	}
+
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	eniMAC, err := findEniMAC(ctx, imds, result.IPs[0].Address.IP)
+	if err != nil {
+		return 0, err
+	}
+	link, err := waitForLinkByMAC(eniMAC, netConf.LinkTimeout.Duration)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+// setupEniRouteMTUs adds the RouteMTUs for ipVersion to an ENI route
+// table (via gw), and removes any that are no longer configured.
+func setupEniRouteMTUs(netConf *NetConf, eniLink netlink.Link, ipVersion int, table int, gw net.IP) error {
+	family := unix.AF_INET
+	if ipVersion == 6 {
+		family = unix.AF_INET6
+	}
+
+	want := make(map[string]bool)
+	for _, r := range routeMTUsFor(netConf.RouteMTUs, ipVersion) {
+		route := netlink.Route{
+			Table:     table,
+			LinkIndex: eniLink.Attrs().Index,
+			Dst:       r.dst(),
+			Gw:        gw,
+			MTU:       r.MTU,
+			Scope:     netlink.SCOPE_UNIVERSE,
+		}
+		if err := netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to add route (%s): %v", route, err)
+		}
+		want[route.Dst.String()] = true
+	}
+
+	// The only other gateway route in the table is the default
+	// route, so anything else is a stale RouteMTU.
+	filter := &netlink.Route{Table: table}
+	routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to list routes in table %d: %v", table, err)
+	}
+	for i := range routes {
+		r := &routes[i]
+		if r.Gw == nil || isDefaultRoute(r.Dst) || want[r.Dst.String()] {
+			continue
+		}
+		if err := netlink.RouteDel(r); err != nil {
+			if !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("failed to delete route (%s): %v", r, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// containerRouteMTUs returns the pod netns RouteMTU routes for ipc,
+// via its gateway.
+func containerRouteMTUs(routeMTUs []RouteMTU, link int, ipc *cniv1.IPConfig) []netlink.Route {
+	ipVersion := 6
+	if ipc.Address.IP.To4() != nil {
+		ipVersion = 4
+	}
+
+	var ret []netlink.Route
+	for _, r := range routeMTUsFor(routeMTUs, ipVersion) {
+		ret = append(ret, netlink.Route{
+			LinkIndex: link,
+			Dst:       r.dst(),
+			Gw:        ipc.Gateway,
+			Src:       ipc.Address.IP,
+			MTU:       r.MTU,
+			Scope:     netlink.SCOPE_UNIVERSE,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,102 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouteMTUsConf(t *testing.T) {
+	conf, err := loadConf([]byte(`{"firewall": "nftables", "routeMTUs": [{"dst": "0.0.0.0/0", "mtu": 1500}, {"dst": "10.100.0.0/16", "mtu": 8500}, {"dst": "::/0", "mtu": 1500}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, 0, conf.MTU, "inherit by default")
+	assert.Len(t, routeMTUsFor(conf.RouteMTUs, 4), 2)
+	assert.Len(t, routeMTUsFor(conf.RouteMTUs, 6), 1)
+
+	_, err = loadConf([]byte(`{"firewall": "nftables", "routeMTUs": [{"dst": "::/0", "mtu": 1000}]}`))
+	assert.Error(t, err, "below IPv6 minimum")
+
+	_, err = loadConf([]byte(`{"firewall": "nftables", "routeMTUs": [{"mtu": 1500}]}`))
+	assert.Error(t, err, "missing dst")
+}
+
+func TestSetupEniRouteMTUs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	const table = 10
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		la := netlink.NewLinkAttrs()
+		la.Name = "eni0"
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "eni0p"}))
+		link, err := netlink.LinkByName("eni0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(link))
+		addr, err := netlink.ParseAddr("10.0.0.10/24")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(link, addr))
+
+		gw := net.ParseIP("10.0.0.1")
+		_, dflt, _ := net.ParseCIDR("0.0.0.0/0")
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{Table: table, LinkIndex: link.Attrs().Index, Dst: dflt, Gw: gw}))
+
+		conf, err := loadConf([]byte(`{"firewall": "nftables", "routeMTUs": [{"dst": "192.168.0.0/16", "mtu": 1500}, {"dst": "172.16.0.0/12", "mtu": 8500}, {"dst": "fd00::/8", "mtu": 1500}]}`))
+		require.NoError(t, err)
+
+		routeMTUs := func() map[string]int {
+			routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			require.NoError(t, err)
+			ret := make(map[string]int)
+			for _, r := range routes {
+				if !isDefaultRoute(r.Dst) {
+					ret[r.Dst.String()] = r.MTU
+				}
+			}
+			return ret
+		}
+
+		require.NoError(t, setupEniRouteMTUs(conf, link, 4, table, gw))
+		assert.Equal(t, map[string]int{"192.168.0.0/16": 1500, "172.16.0.0/12": 8500}, routeMTUs())
+
+		// Changed config replaces/removes old routes
+		conf.RouteMTUs = conf.RouteMTUs[:1]
+		conf.RouteMTUs[0].MTU = 1400
+		require.NoError(t, setupEniRouteMTUs(conf, link, 4, table, gw))
+		assert.Equal(t, map[string]int{"192.168.0.0/16": 1400}, routeMTUs())
+
+		// Default route is untouched
+		routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: table, Dst: dflt}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+		require.NoError(t, err)
+		assert.Len(t, routes, 1)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
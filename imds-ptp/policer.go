@@ -0,0 +1,463 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ENIs have per-instance packets-per-second and conntrack
+// allowances, and one busy pod can use them up for the whole node.
+// An egress limit polices pod-to-network traffic with tc on the host
+// veth (ie: its ingress), dropping anything over the limit.
+//
+// Unlike the bandwidth plugin's TBF shaper, this can limit packets
+// per second as well as bits per second.  Both use the host veth
+// ingress qdisc, so a pod can't also have a bandwidth plugin
+// egressRate.
+//
+// The limit comes from netConf.EgressLimit, then
+// runtimeConfig.egressLimit, then pod annotations (via the containerd
+// "io.kubernetes.cri.pod-annotations" capability).  Pod annotations
+// are set by whoever can create pods, so runtimeConfig and
+// annotations can only lower the netConf limit, field by field,
+// unless netConf.EgressLimitOverride is set.
+
+// EgressLimit is a per-pod egress limit.  Zero means unlimited.
+type EgressLimit struct {
+	// Bits per second, and burst in bits (as for the bandwidth
+	// plugin)
+	Rate  uint64 `json:"rate,omitempty"`
+	Burst uint64 `json:"burst,omitempty"`
+	// Packets per second, and burst in packets
+	PPS      uint64 `json:"pps,omitempty"`
+	PPSBurst uint64 `json:"ppsBurst,omitempty"`
+}
+
+// Pod annotations.  Values are integers, with an optional k, M, G or
+// T (decimal) suffix.
+const (
+	annotationEgressRate     = "imds-ptp.aws/egress-rate"
+	annotationEgressBurst    = "imds-ptp.aws/egress-burst"
+	annotationEgressPPS      = "imds-ptp.aws/egress-pps"
+	annotationEgressPPSBurst = "imds-ptp.aws/egress-pps-burst"
+)
+
+const (
+	// Default burst, as a fraction of a second
+	defaultBurstDivisor = 10
+	// Minimum default bursts
+	minDefaultBurst    = 64 * 1024 * 8
+	minDefaultPPSBurst = 10
+
+	// Filter priorities.  The rate policer runs first.
+	policerPrioRate = 1
+	policerPrioPPS  = 2
+	policerHandle   = 1
+
+	// Not (yet) in vishvananda/netlink.  Linux 5.13+
+	tcaPolicePktRate64  = 10
+	tcaPolicePktBurst64 = 11
+)
+
+// merge returns l, with any non-zero fields of o.
+func (l EgressLimit) merge(o EgressLimit) EgressLimit {
+	if o.Rate != 0 {
+		l.Rate = o.Rate
+	}
+	if o.Burst != 0 {
+		l.Burst = o.Burst
+	}
+	if o.PPS != 0 {
+		l.PPS = o.PPS
+	}
+	if o.PPSBurst != 0 {
+		l.PPSBurst = o.PPSBurst
+	}
+	return l
+}
+
+// tighten returns l, with any fields of o that are lower.  Zero is
+// unlimited.
+func (l EgressLimit) tighten(o EgressLimit) EgressLimit {
+	lower := func(a, b uint64) uint64 {
+		if b != 0 && (a == 0 || b < a) {
+			return b
+		}
+		return a
+	}
+	l.Rate = lower(l.Rate, o.Rate)
+	l.Burst = lower(l.Burst, o.Burst)
+	l.PPS = lower(l.PPS, o.PPS)
+	l.PPSBurst = lower(l.PPSBurst, o.PPSBurst)
+	return l
+}
+
+// withDefaultBursts returns l, with unset bursts filled in from the
+// rates.
+func (l EgressLimit) withDefaultBursts() EgressLimit {
+	if l.Rate != 0 && l.Burst == 0 {
+		l.Burst = max(l.Rate/defaultBurstDivisor, minDefaultBurst)
+	}
+	if l.PPS != 0 && l.PPSBurst == 0 {
+		l.PPSBurst = max(l.PPS/defaultBurstDivisor, minDefaultPPSBurst)
+	}
+	return l
+}
+
+// IsZero returns true if there is no limit.
+func (l EgressLimit) IsZero() bool {
+	return l.Rate == 0 && l.PPS == 0
+}
+
+// parseSI parses an integer with an optional decimal SI suffix, eg:
+// "10M".
+func parseSI(s string) (uint64, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1e3
+	case strings.HasSuffix(s, "M"):
+		mult = 1e6
+	case strings.HasSuffix(s, "G"):
+		mult = 1e9
+	case strings.HasSuffix(s, "T"):
+		mult = 1e12
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint64/mult {
+		return 0, fmt.Errorf("%s: value out of range", s)
+	}
+	return v * mult, nil
+}
+
+// annotationEgressLimit returns the limit from pod annotations.
+func annotationEgressLimit(annotations map[string]string) (EgressLimit, error) {
+	var l EgressLimit
+	for _, a := range []struct {
+		key string
+		val *uint64
+	}{
+		{annotationEgressRate, &l.Rate},
+		{annotationEgressBurst, &l.Burst},
+		{annotationEgressPPS, &l.PPS},
+		{annotationEgressPPSBurst, &l.PPSBurst},
+	} {
+		s, ok := annotations[a.key]
+		if !ok {
+			continue
+		}
+		v, err := parseSI(s)
+		if err != nil {
+			return l, fmt.Errorf("invalid annotation %s=%q: %v", a.key, s, err)
+		}
+		*a.val = v
+	}
+	return l, nil
+}
+
+// podEgressLimit returns the egress limit for a pod, with default
+// bursts filled in.
+func podEgressLimit(netConf *NetConf) (EgressLimit, error) {
+	var pod EgressLimit
+	if netConf.RuntimeConfig.EgressLimit != nil {
+		pod = *netConf.RuntimeConfig.EgressLimit
+	}
+	a, err := annotationEgressLimit(netConf.RuntimeConfig.PodAnnotations)
+	if err != nil {
+		return pod, err
+	}
+	pod = pod.merge(a)
+
+	var l EgressLimit
+	if netConf.EgressLimitOverride {
+		l = netConf.EgressLimit.merge(pod).withDefaultBursts()
+	} else {
+		l = netConf.EgressLimit.tighten(pod).withDefaultBursts()
+		// A pod burst can't be over the default burst for the
+		// netConf rate either
+		def := netConf.EgressLimit.withDefaultBursts()
+		if def.Rate != 0 {
+			l.Burst = min(l.Burst, def.Burst)
+		}
+		if def.PPS != 0 {
+			l.PPSBurst = min(l.PPSBurst, def.PPSBurst)
+		}
+	}
+
+	// tc police takes bytes, as uint32
+	if l.Rate/8 > math.MaxUint32 {
+		return l, fmt.Errorf("egress rate %d too large", l.Rate)
+	}
+	if l.Burst/8 > math.MaxUint32 {
+		return l, fmt.Errorf("egress burst %d too large", l.Burst)
+	}
+	if l.PPSBurst > math.MaxUint32 {
+		return l, fmt.Errorf("egress pps burst %d too large", l.PPSBurst)
+	}
+	if l.Rate != 0 && l.Burst < 8*1500 {
+		return l, fmt.Errorf("egress burst %d smaller than one packet", l.Burst)
+	}
+
+	return l, nil
+}
+
+// setupPolicer applies limit to traffic received on (ie: pod egress
+// via) the host veth.
+func setupPolicer(vethName string, limit EgressLimit) error {
+	if limit.IsZero() {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
+	}
+
+	qdisc := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add ingress qdisc on %s: %v", vethName, err)
+	}
+
+	// matchall filters can't be replaced, only deleted and re-added
+	for _, prio := range []uint16{policerPrioRate, policerPrioPPS} {
+		if err := delPolicer(link.Attrs().Index, prio); err != nil {
+			return err
+		}
+	}
+
+	if limit.Rate != 0 {
+		police := netlink.NewPoliceAction()
+		police.Rate = uint32(limit.Rate / 8)
+		police.Burst = uint32(limit.Burst / 8)
+		police.ExceedAction = netlink.TC_POLICE_SHOT
+		// Continue to the next filter
+		police.NotExceedAction = netlink.TC_POLICE_UNSPEC
+
+		filter := &netlink.MatchAll{
+			FilterAttrs: policerFilterAttrs(link.Attrs().Index, policerPrioRate),
+			Actions:     []netlink.Action{police},
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add rate policer on %s: %v", vethName, err)
+		}
+	}
+
+	if limit.PPS != 0 {
+		if err := addPPSPolicer(link.Attrs().Index, limit.PPS, limit.PPSBurst); err != nil {
+			return fmt.Errorf("failed to add pps policer on %s: %v", vethName, err)
+		}
+	}
+
+	return nil
+}
+
+func policerFilterAttrs(linkIndex int, prio uint16) netlink.FilterAttrs {
+	return netlink.FilterAttrs{
+		LinkIndex: linkIndex,
+		Parent:    netlink.HANDLE_MIN_INGRESS,
+		Handle:    policerHandle,
+		Priority:  prio,
+		Protocol:  unix.ETH_P_ALL,
+	}
+}
+
+func delPolicer(linkIndex int, prio uint16) error {
+	filter := &netlink.MatchAll{FilterAttrs: policerFilterAttrs(linkIndex, prio)}
+	if err := netlink.FilterDel(filter); err != nil {
+		if !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("failed to delete policer: %v", err)
+		}
+	}
+	return nil
+}
+
+// addPPSPolicer adds a packets-per-second matchall police filter.
+// The netlink library's PoliceAction is bytes only, so this builds
+// the request itself.
+func addPPSPolicer(linkIndex int, pps, burst uint64) error {
+	attrs := policerFilterAttrs(linkIndex, policerPrioPPS)
+
+	req := nl.NewNetlinkRequest(unix.RTM_NEWTFILTER, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(attrs.LinkIndex),
+		Handle:  attrs.Handle,
+		Parent:  attrs.Parent,
+		Info:    netlink.MakeHandle(attrs.Priority, nl.Swap16(attrs.Protocol)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("matchall")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	actions := options.AddRtAttr(nl.TCA_MATCHALL_ACT, nil)
+	action := actions.AddRtAttr(nl.TCA_ACT_TAB, nil)
+	action.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated("police"))
+	aopts := action.AddRtAttr(nl.TCA_ACT_OPTIONS, nil)
+	police := nl.TcPolice{Action: int32(netlink.TC_POLICE_SHOT)}
+	aopts.AddRtAttr(nl.TCA_POLICE_TBF, police.Serialize())
+	unspec := int32(netlink.TC_POLICE_UNSPEC) // continue
+	aopts.AddRtAttr(nl.TCA_POLICE_RESULT, nl.Uint32Attr(uint32(unspec)))
+	aopts.AddRtAttr(tcaPolicePktRate64, nl.Uint64Attr(pps))
+	// Burst is the time to send burst packets, in ticks
+	aopts.AddRtAttr(tcaPolicePktBurst64, nl.Uint64Attr(uint64(netlink.Xmittime(pps, uint32(burst)))))
+	req.AddData(options)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// PolicerStats are the counters for one policer.
+type PolicerStats struct {
+	Kind    string // "rate" or "pps"
+	Packets uint32 // including drops
+	Drops   uint32
+}
+
+// policerStats returns the counters for the policers on a host
+// veth.
+func policerStats(vethName string) ([]PolicerStats, error) {
+	link, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", vethName, err)
+	}
+
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filters on %s: %v", vethName, err)
+	}
+
+	var ret []PolicerStats
+	for _, f := range filters {
+		m, ok := f.(*netlink.MatchAll)
+		if !ok || m.Handle != policerHandle || len(m.Actions) != 1 {
+			continue
+		}
+		police, ok := m.Actions[0].(*netlink.PoliceAction)
+		if !ok {
+			continue
+		}
+		s := PolicerStats{}
+		switch m.Priority {
+		case policerPrioRate:
+			s.Kind = "rate"
+		case policerPrioPPS:
+			s.Kind = "pps"
+		default:
+			continue
+		}
+		if st := police.Statistics; st != nil {
+			if st.Basic != nil {
+				s.Packets = st.Basic.Packets
+			}
+			if st.Queue != nil {
+				s.Drops = st.Queue.Drops
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// checkPolicer verifies the policers for limit are on the host veth.
+func checkPolicer(vethName string, limit EgressLimit) error {
+	stats, err := policerStats(vethName)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, s := range stats {
+		have[s.Kind] = true
+	}
+	if have["rate"] != (limit.Rate != 0) {
+		return fmt.Errorf("rate policer on %s doesn't match egress limit", vethName)
+	}
+	if have["pps"] != (limit.PPS != 0) {
+		return fmt.Errorf("pps policer on %s doesn't match egress limit", vethName)
+	}
+	return nil
+}
+
+// logPolicerStats logs the final policer counters for a host veth,
+// before it is removed.
+func logPolicerStats(vethName string) {
+	stats, err := policerStats(vethName)
+	if err != nil {
+		slog.Debug("No policer stats", "veth", vethName, "error", err)
+		return
+	}
+	for _, s := range stats {
+		level := slog.LevelDebug
+		if s.Drops != 0 {
+			level = slog.LevelInfo
+		}
+		slog.Log(context.TODO(), level, "Egress policer", "veth", vethName, "kind", s.Kind, "packets", s.Packets, "drops", s.Drops)
+	}
+}
+
+// policerStatsCmd implements the "policer-stats" subcommand, which
+// prints the policer counters for every host veth.
+func policerStatsCmd(args []string) error {
+	fs := flag.NewFlagSet("policer-stats", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "VETH\tKIND\tPACKETS\tDROPS")
+	for _, link := range links {
+		if _, ok := link.(*netlink.Veth); !ok {
+			continue
+		}
+		stats, err := policerStats(link.Attrs().Name)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", link.Attrs().Name, s.Kind, s.Packets, s.Drops)
+		}
+	}
+	return w.Flush()
+}
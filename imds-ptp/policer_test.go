@@ -0,0 +1,200 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestPodEgressLimit(t *testing.T) {
+	netConf := &NetConf{EgressLimit: EgressLimit{Rate: 100e6, PPS: 1000}}
+
+	l, err := podEgressLimit(netConf)
+	require.NoError(t, err)
+	assert.Equal(t, EgressLimit{Rate: 100e6, Burst: 10e6, PPS: 1000, PPSBurst: 100}, l)
+
+	netConf.RuntimeConfig.EgressLimit = &EgressLimit{PPS: 50}
+	l, err = podEgressLimit(netConf)
+	require.NoError(t, err)
+	assert.Equal(t, EgressLimit{Rate: 100e6, Burst: 10e6, PPS: 50, PPSBurst: minDefaultPPSBurst}, l)
+
+	netConf.RuntimeConfig.PodAnnotations = map[string]string{
+		annotationEgressRate:     "1M",
+		annotationEgressPPSBurst: "20",
+		"unrelated":              "x",
+	}
+	l, err = podEgressLimit(netConf)
+	require.NoError(t, err)
+	assert.Equal(t, EgressLimit{Rate: 1e6, Burst: minDefaultBurst, PPS: 50, PPSBurst: 20}, l)
+
+	netConf.RuntimeConfig.PodAnnotations[annotationEgressPPS] = "lots"
+	_, err = podEgressLimit(netConf)
+	assert.Error(t, err)
+
+	_, err = podEgressLimit(&NetConf{EgressLimit: EgressLimit{Rate: 1e12}})
+	assert.Error(t, err, "rate too large")
+
+	_, err = podEgressLimit(&NetConf{EgressLimit: EgressLimit{Rate: 1e6, Burst: 100}})
+	assert.Error(t, err, "burst too small")
+
+	l, err = podEgressLimit(&NetConf{})
+	require.NoError(t, err)
+	assert.True(t, l.IsZero())
+}
+
+func TestPodEgressLimitTighten(t *testing.T) {
+	netConf := &NetConf{EgressLimit: EgressLimit{Rate: 10e6, PPS: 1000}}
+	netConf.RuntimeConfig.EgressLimit = &EgressLimit{PPS: 5000}
+	netConf.RuntimeConfig.PodAnnotations = map[string]string{
+		annotationEgressRate:     "1G",
+		annotationEgressBurst:    "1G",
+		annotationEgressPPSBurst: "1k",
+	}
+
+	// Pod asks for more than the default, and doesn't get it
+	l, err := podEgressLimit(netConf)
+	require.NoError(t, err)
+	assert.Equal(t, EgressLimit{Rate: 10e6, Burst: 1e6, PPS: 1000, PPSBurst: 100}, l)
+
+	// Unless the admin allows it
+	netConf.EgressLimitOverride = true
+	l, err = podEgressLimit(netConf)
+	require.NoError(t, err)
+	assert.Equal(t, EgressLimit{Rate: 1e9, Burst: 1e9, PPS: 5000, PPSBurst: 1000}, l)
+
+	// No default is unlimited, so anything is lower
+	netConf = &NetConf{}
+	netConf.RuntimeConfig.PodAnnotations = map[string]string{annotationEgressPPS: "100"}
+	l, err = podEgressLimit(netConf)
+	require.NoError(t, err)
+	assert.Equal(t, EgressLimit{PPS: 100, PPSBurst: minDefaultPPSBurst}, l)
+}
+
+func TestPolicer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	hostNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(hostNS)
+	defer hostNS.Close()
+
+	podNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(podNS)
+	defer podNS.Close()
+
+	limit := EgressLimit{Rate: 100e6, Burst: 10e6, PPS: 10, PPSBurst: 10}
+
+	var hostMAC net.HardwareAddr
+	var unsupported bool
+	err = hostNS.Do(func(ns.NetNS) error {
+		la := netlink.NewLinkAttrs()
+		la.Name = "veth0"
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "eth0"}))
+		link, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+		hostMAC = link.Attrs().HardwareAddr
+		require.NoError(t, netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}}))
+		require.NoError(t, netlink.LinkSetUp(link))
+
+		peer, err := netlink.LinkByName("eth0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetNsFd(peer, int(podNS.Fd())))
+
+		assert.Error(t, checkPolicer("veth0", limit))
+
+		// Not every kernel has cls_matchall and act_police
+		require.NoError(t, netlink.QdiscAdd(&netlink.Ingress{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: link.Attrs().Index,
+				Handle:    netlink.MakeHandle(0xffff, 0),
+				Parent:    netlink.HANDLE_INGRESS,
+			},
+		}))
+		if err := addPPSPolicer(link.Attrs().Index, 10, 10); errors.Is(err, unix.ENOENT) {
+			unsupported = true
+			return nil
+		} else {
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, setupPolicer("veth0", limit))
+		assert.NoError(t, checkPolicer("veth0", limit))
+
+		// Idempotent
+		require.NoError(t, setupPolicer("veth0", limit))
+		assert.NoError(t, checkPolicer("veth0", limit))
+
+		assert.Error(t, checkPolicer("veth0", EgressLimit{PPS: 10}), "unexpected rate policer")
+
+		return nil
+	})
+	require.NoError(t, err)
+	if unsupported {
+		t.Skip("kernel lacks matchall or police")
+	}
+
+	const sent = 200
+	err = podNS.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(24, 32)}}))
+		require.NoError(t, netlink.LinkSetUp(link))
+		require.NoError(t, netlink.NeighAdd(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           net.ParseIP("10.0.0.1"),
+			HardwareAddr: hostMAC,
+		}))
+
+		// Unconnected, so ICMP port unreachable is ignored
+		conn, err := net.ListenPacket("udp4", ":0")
+		require.NoError(t, err)
+		defer conn.Close()
+		dst := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9}
+		for i := 0; i < sent; i++ {
+			_, err := conn.WriteTo([]byte("hello"), dst)
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		stats, err := policerStats("veth0")
+		require.NoError(t, err)
+		require.Len(t, stats, 2)
+
+		byKind := make(map[string]PolicerStats)
+		for _, s := range stats {
+			byKind[s.Kind] = s
+		}
+		assert.Zero(t, byKind["rate"].Drops)
+		assert.Greater(t, byKind["pps"].Drops, uint32(sent/2))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,396 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/logging"
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+	"github.com/anguslees/aws-cni-plugins/internal/procsys"
+)
+
+// "imds-ptp repair" rebuilds host routing for existing pods, eg: after
+// a host network restart or "ip rule flush".  Pods are found from
+// their host veths and pod records, and the addresses and routes on
+// the pod end of each veth.
+//
+// ipvlan pods have no host veth, and are not repaired.
+
+// repairConf extracts our plugin config from a CNI .conf or
+// .conflist file.
+func repairConf(data []byte) (*NetConf, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, err
+	}
+
+	rawPlugins, ok := top["plugins"]
+	if !ok {
+		// Plain .conf
+		return loadConf(data)
+	}
+
+	var plugins []map[string]json.RawMessage
+	if err := json.Unmarshal(rawPlugins, &plugins); err != nil {
+		return nil, err
+	}
+	for _, p := range plugins {
+		var typ string
+		if err := json.Unmarshal(p["type"], &typ); err != nil || typ != pluginName {
+			continue
+		}
+		// Inherited from the list, as libcni does
+		for _, k := range []string{"name", "cniVersion"} {
+			if v, ok := top[k]; ok {
+				p[k] = v
+			}
+		}
+		pdata, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		return loadConf(pdata)
+	}
+
+	return nil, fmt.Errorf("no %s plugin found in plugin list", pluginName)
+}
+
+// netnsPaths returns a path for each network namespace with an ID
+// in the current namespace, by ID.  Pod namespaces are pinned under
+// /run/netns by the runtime, and/or held by a pod process.
+func netnsPaths() (map[int]string, error) {
+	var paths []string
+	for _, pattern := range []string{"/run/netns/*", "/var/run/netns/*", "/proc/[0-9]*/ns/net"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+
+	ret := make(map[int]string)
+	seen := make(map[uint64]bool)
+	for _, path := range paths {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			// Process exited, etc
+			continue
+		}
+		if seen[st.Ino] {
+			continue
+		}
+		seen[st.Ino] = true
+
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		id, err := netlink.GetNetNsIdByFd(int(f.Fd()))
+		f.Close()
+		if err != nil || id < 0 {
+			continue
+		}
+		ret[id] = path
+	}
+	return ret, nil
+}
+
+// repairablePod is what repair needs to know about a pod.
+type repairablePod struct {
+	IPs []net.IP
+	// Gateways are the pod's gateways, ie: the host veth
+	// addresses.  Unknown if the pod netns wasn't found.
+	Gateways []net.IP
+	// Recorded is true if ADD recorded the pod, so it is
+	// definitely ours.
+	Recorded bool
+}
+
+// findPods returns each pod, by host veth name.  Pods are host veths
+// with the other end in another netns, or recorded by ADD: older
+// versions picked random host veth names, so VethPrefix says nothing.
+// The IPs are the addresses on the other end of the veth, in the pod
+// netns, so it doesn't matter what host routing has been lost.
+func findPods(netConf *NetConf) (map[string]*repairablePod, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	nsPaths, err := netnsPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := newPodRecords(netConf.DataDir).List()
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]podRecord, len(records))
+	for _, rec := range records {
+		if rec.VethName != "" {
+			recorded[rec.VethName] = rec
+		}
+	}
+
+	ret := make(map[string]*repairablePod)
+	for _, link := range links {
+		if _, ok := link.(*netlink.Veth); !ok {
+			continue
+		}
+		attrs := link.Attrs()
+		rec, isRecorded := recorded[attrs.Name]
+		if attrs.NetNsID < 0 && !isRecorded {
+			// Peer is on the host, so not a pod
+			continue
+		}
+
+		pod := &repairablePod{Recorded: isRecorded}
+		if nsPath, ok := nsPaths[attrs.NetNsID]; ok {
+			err := ns.WithNetNSPath(nsPath, func(ns.NetNS) error {
+				var err error
+				pod.IPs, pod.Gateways, err = podPeerAddrs(attrs.ParentIndex)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list addresses of %s peer: %v", attrs.Name, err)
+			}
+		} else {
+			log.Printf("Failed to find netns %d for %s", attrs.NetNsID, attrs.Name)
+		}
+
+		if len(pod.IPs) == 0 && isRecorded {
+			// Fall back to what ADD recorded
+			for _, s := range rec.IPs {
+				if ip := net.ParseIP(s); ip != nil {
+					pod.IPs = append(pod.IPs, ip)
+				}
+			}
+		}
+		if len(pod.IPs) != 0 {
+			ret[attrs.Name] = pod
+		}
+	}
+
+	return ret, nil
+}
+
+// podPeerAddrs returns the pod IPs and gateways of the pod end of a
+// veth, by ifindex in the current (pod) netns.  The gateways are
+// from the direct host routes that setupContainerRoutes adds.  NB:
+// IPv6 routes have no scope.
+func podPeerAddrs(peerIndex int) ([]net.IP, []net.IP, error) {
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addrs, err := netlink.AddrList(peer, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if addr.Scope == int(netlink.SCOPE_UNIVERSE) {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	routes, err := netlink.RouteList(peer, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var gws []net.IP
+	for _, r := range routes {
+		if r.Gw != nil || r.Src == nil || r.Dst == nil {
+			continue
+		}
+		if ones, bits := r.Dst.Mask.Size(); ones != bits {
+			continue
+		}
+		gws = append(gws, r.Dst.IP)
+	}
+
+	return ips, gws, nil
+}
+
+// repairPod re-applies host routing for one pod.  Everything here is
+// idempotent.
+func repairPod(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf, primaryMAC, vethName string, pod *repairablePod) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	veth, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
+	}
+
+	// Nothing is rolled back on failure: a partial repair is
+	// better than none.
+	tx := &undoList{}
+
+	// As setupHostVeth.  A chained plugin's host interface isn't
+	// ours to configure.
+	var gateways []net.IP
+	if netConf.Mode != modeChained {
+		gateways = pod.Gateways
+	}
+	for _, gw := range gateways {
+		_, maskLen := familyMaskLen(gw)
+		addr := &netlink.Addr{
+			IPNet: &net.IPNet{IP: gw, Mask: net.CIDRMask(maskLen, maskLen)},
+			Scope: int(netlink.SCOPE_LINK),
+		}
+		if maskLen == 128 {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := netlink.AddrReplace(veth, addr); err != nil {
+			return fmt.Errorf("failed to add IP addr %s to veth: %v", addr.IPNet, err)
+		}
+	}
+
+	for _, podIP := range pod.IPs {
+		ipVersion := 6
+		if podIP.To4() != nil {
+			ipVersion = 4
+		}
+		_, maskLen := familyMaskLen(podIP)
+		ipc := &cniv1.IPConfig{
+			Address: net.IPNet{
+				IP:   podIP,
+				Mask: net.CIDRMask(maskLen, maskLen),
+			},
+		}
+
+		eniMAC, err := findEniMAC(ctx, imds, podIP)
+		if err != nil {
+			return err
+		}
+
+		if err := setupHostEniIface(ec2Metadata, procSys, netConf, eniMAC, ipVersion); err != nil {
+			return err
+		}
+		if eniMAC != primaryMAC && !netConf.Secondary {
+			if err := setupHostEniIface(ec2Metadata, procSys, netConf, primaryMAC, ipVersion); err != nil {
+				return err
+			}
+		}
+
+		route := &netlink.Route{
+			LinkIndex: veth.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       &ipc.Address,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route on host: %v", err)
+		}
+
+		if err := setupHostEniPodRoute(ec2Metadata, netConf, vethName, eniMAC, ipc, tx); err != nil {
+			return err
+		}
+	}
+
+	return setupAntiSpoof(procSys, netConf, vethName, pod.IPs)
+}
+
+// repairHost repairs host routing for all pods.
+func repairHost(ec2Metadata metadata.EC2MetadataIface, procSys procsys.ProcSys, netConf *NetConf) error {
+	ctx := context.TODO()
+
+	imds := metadata.NewTypedIMDS(ec2Metadata)
+
+	if err := migrateRouting(netConf.DataDir, netConf.Routing); err != nil {
+		return err
+	}
+	if err := resolveFirewall(netConf); err != nil {
+		return err
+	}
+
+	primaryMAC, err := imds.GetMAC(ctx)
+	if err != nil {
+		return err
+	}
+
+	pods, err := findPods(netConf)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for vethName, pod := range pods {
+		err := repairPod(ec2Metadata, procSys, netConf, primaryMAC, vethName, pod)
+		if errors.Is(err, errNoENI) && !pod.Recorded {
+			// Some other plugin's pod
+			log.Printf("Skipping %s %v: not on our ENIs", vethName, pod.IPs)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to repair %s %v: %v", vethName, pod.IPs, err)
+			errs = append(errs, fmt.Errorf("%s: %v", vethName, err))
+			continue
+		}
+		log.Printf("Repaired %s %v", vethName, pod.IPs)
+	}
+
+	return errors.Join(errs...)
+}
+
+// repair implements the "repair" subcommand.
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	confPath := fs.String("config", "", "CNI config file (.conf or .conflist) containing the imds-ptp plugin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *confPath == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	data, err := os.ReadFile(*confPath)
+	if err != nil {
+		return err
+	}
+	netConf, err := repairConf(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", *confPath, err)
+	}
+
+	done, err := logging.Setup(pluginName, netConf.Conf, "repair", nil)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	ec2Metadata, err := newEC2Metadata(netConf)
+	if err != nil {
+		return err
+	}
+
+	return repairHost(ec2Metadata, procsys.NewProcSys(), netConf)
+}
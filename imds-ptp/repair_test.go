@@ -0,0 +1,136 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestRepairConf(t *testing.T) {
+	conf, err := repairConf([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "imds-ptp", "firewall": "nftables", "mtu": 1234}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1234, conf.MTU)
+
+	conf, err = repairConf([]byte(`{
+  "cniVersion": "1.0.0",
+  "name": "test",
+  "plugins": [
+    {"type": "portmap"},
+    {"type": "imds-ptp", "firewall": "nftables", "mtu": 4321}
+  ]
+}`))
+	require.NoError(t, err)
+	assert.Equal(t, 4321, conf.MTU)
+	assert.Equal(t, "test", conf.Name)
+
+	_, err = repairConf([]byte(`{"name": "test", "plugins": [{"type": "bridge"}]}`))
+	assert.Error(t, err)
+}
+
+func TestFindPods(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	podNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(podNS)
+	defer podNS.Close()
+
+	netConf := &NetConf{Routing: defaultRoutingConf, VethPrefix: "eni", DataDir: t.TempDir()}
+
+	// veth2 is recorded, but not in a netns we can find
+	require.NoError(t, newPodRecords(netConf.DataDir).Put("abc", "eth0", podRecord{
+		IPs:      []string{"10.0.0.6"},
+		VethName: "veth2",
+	}))
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		for _, name := range []string{"vethab12cd34", "veth1", "veth2"} {
+			la := netlink.NewLinkAttrs()
+			la.Name = name
+			require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}))
+		}
+
+		// vethab12cd34 is a pod from an older version, with a
+		// random name and no host routes (eg: flushed)
+		peer, err := netlink.LinkByName("vethab12cd34p")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetNsFd(peer, int(podNS.Fd())))
+		err = podNS.Do(func(ns.NetNS) error {
+			peer, err := netlink.LinkByName("vethab12cd34p")
+			require.NoError(t, err)
+			for _, s := range []string{"10.0.0.5/24", "2001:db8::5/64"} {
+				addr, err := netlink.ParseAddr(s)
+				require.NoError(t, err)
+				require.NoError(t, netlink.AddrAdd(peer, addr))
+			}
+			// For the IPv6 link-local address
+			require.NoError(t, netlink.LinkSetUp(peer))
+
+			// As setupContainerRoutes
+			return netlink.RouteAdd(&netlink.Route{
+				LinkIndex: peer.Attrs().Index,
+				Dst:       &net.IPNet{IP: net.ParseIP("169.254.0.1"), Mask: net.CIDRMask(32, 32)},
+				Scope:     netlink.SCOPE_LINK,
+				Src:       net.ParseIP("10.0.0.5"),
+			})
+		})
+		require.NoError(t, err)
+
+		// veth1 is not a pod: both ends on the host
+		addr, err := netlink.ParseAddr("10.0.1.5/24")
+		require.NoError(t, err)
+		peer, err = netlink.LinkByName("veth1p")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(peer, addr))
+
+		pods, err := findPods(netConf)
+		require.NoError(t, err)
+		require.Contains(t, pods, "vethab12cd34")
+		assert.ElementsMatch(t, []string{"10.0.0.5", "2001:db8::5"}, ipStrings(pods["vethab12cd34"].IPs))
+		assert.Equal(t, []string{"169.254.0.1"}, ipStrings(pods["vethab12cd34"].Gateways))
+		assert.False(t, pods["vethab12cd34"].Recorded)
+		require.Contains(t, pods, "veth2")
+		assert.Equal(t, []string{"10.0.0.6"}, ipStrings(pods["veth2"].IPs))
+		assert.True(t, pods["veth2"].Recorded)
+		assert.NotContains(t, pods, "veth1")
+		assert.NotContains(t, pods, "veth1p")
+		assert.NotContains(t, pods, "veth2p")
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func ipStrings(ips []net.IP) []string {
+	ret := make([]string, len(ips))
+	for i, ip := range ips {
+		ret[i] = ip.String()
+	}
+	return ret
+}
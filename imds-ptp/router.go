@@ -0,0 +1,262 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// routerCacheTTL is how long a cached router address is trusted,
+// when the kernel has no current route to say otherwise.
+const routerCacheTTL = 24 * time.Hour
+
+// routerCache remembers discovered IPv6 router addresses, per ENI, so
+// only the first pod on an ENI waits for an RA.  The kernel's own RA
+// route takes precedence (see currentRouter6), and entries expire
+// after routerCacheTTL.
+type routerCache struct {
+	dir string
+}
+
+func newRouterCache(dataDir string) routerCache {
+	return routerCache{dir: filepath.Join(dataDir, "routers")}
+}
+
+func (c routerCache) path(mac string) string {
+	return filepath.Join(c.dir, mac)
+}
+
+// Get returns the cached router address for mac, or nil if unknown
+// or expired.
+func (c routerCache) Get(mac string) (net.IP, error) {
+	fi, err := os.Stat(c.path(mac))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(fi.ModTime()) > routerCacheTTL {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(c.path(mac))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(data)))
+	if ip == nil {
+		// Corrupt?  Just rediscover.
+		return nil, nil
+	}
+	return ip, nil
+}
+
+// Put records the router address for mac.
+func (c routerCache) Put(mac string, ip net.IP) error {
+	return writeFileAtomic(c.path(mac), []byte(ip.String()+"\n"))
+}
+
+// currentRouter6 returns the router of the kernel's IPv6 default
+// route on link (from an RA), or nil if there is none right now.
+func currentRouter6(link netlink.Link) (net.IP, error) {
+	routes, err := netlink.RouteListFiltered(unix.AF_INET6, &netlink.Route{
+		Table:     unix.RT_TABLE_MAIN,
+		LinkIndex: link.Attrs().Index,
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IPv6 routes on %s: %v", link.Attrs().Name, err)
+	}
+	for _, r := range routes {
+		if isDefaultRoute(r.Dst) && r.Gw != nil && !r.Gw.IsUnspecified() {
+			return r.Gw, nil
+		}
+	}
+	return nil, nil
+}
+
+// discoverRouter6 waits (up to timeout) for the kernel to install an
+// IPv6 default route on link from a router advertisement, and
+// returns the router address.
+func discoverRouter6(ctx context.Context, link netlink.Link, timeout time.Duration, solicit bool) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ch := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	defer close(done)
+
+	// Called from the subscription goroutine
+	subErr := make(chan error, 1)
+	err := netlink.RouteSubscribeWithOptions(ch, done, netlink.RouteSubscribeOptions{
+		// ListExisting avoids a race between listing and
+		// subscribing.
+		ListExisting: true,
+		ErrorCallback: func(err error) {
+			select {
+			case subErr <- err:
+			default:
+				// Already have one
+			}
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to route updates: %v", err)
+	}
+
+	if solicit {
+		if err := sendRouterSolicitation(link.Attrs().Name); err != nil {
+			// Not fatal, we'll just wait for the
+			// next unsolicited RA.
+			log.Printf("Failed to send router solicitation on %s: %v", link.Attrs().Name, err)
+		}
+	}
+
+	log.Printf("Waiting for IPv6 router advertisement on %s", link.Attrs().Name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out after %s waiting for IPv6 router advertisement on %s", timeout, link.Attrs().Name)
+
+		case u, ok := <-ch:
+			if !ok {
+				var err error
+				select {
+				case err = <-subErr:
+				default:
+				}
+				return nil, fmt.Errorf("route subscription closed: %v", err)
+			}
+			r := u.Route
+			if u.Type != unix.RTM_NEWROUTE ||
+				r.Family != unix.AF_INET6 ||
+				r.Table != unix.RT_TABLE_MAIN ||
+				r.LinkIndex != link.Attrs().Index {
+				continue
+			}
+			if isDefaultRoute(r.Dst) && r.Gw != nil && !r.Gw.IsUnspecified() {
+				// found a defaultroute!
+				return r.Gw, nil
+			}
+		}
+	}
+}
+
+// sendRouterSolicitation sends a single ICMPv6 router solicitation
+// to all-routers on ifName.
+func sendRouterSolicitation(ifName string) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	p := c.IPv6PacketConn()
+	// RFC4861 requires hop limit 255
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := p.SetMulticastInterface(iface); err != nil {
+		return err
+	}
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeRouterSolicitation,
+		Body: &icmp.RawBody{
+			Data: make([]byte, 4), // reserved
+		},
+	}
+	// Checksum is filled in by the kernel
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	allRouters := &net.IPAddr{
+		IP:   net.ParseIP("ff02::2"),
+		Zone: ifName,
+	}
+	_, err = c.WriteTo(b, allRouters)
+	return err
+}
+
+// sendUnsolicitedNA sends a single ICMPv6 unsolicited neighbour
+// advertisement for ip (which must be on iface) to all-nodes on
+// iface.  This is the IPv6 equivalent of gratuitous ARP.
+func sendUnsolicitedNA(iface *net.Interface, ip net.IP) error {
+	// RFC4861 7.2.6: source is an address on the interface
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", ip.String())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	p := c.IPv6PacketConn()
+	// RFC4861 requires hop limit 255
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := p.SetMulticastInterface(iface); err != nil {
+		return err
+	}
+
+	// Flags (Override), target address, and target link-layer
+	// address option
+	data := make([]byte, 4, 4+net.IPv6len+2+len(iface.HardwareAddr))
+	data[0] = 0x20
+	data = append(data, ip.To16()...)
+	data = append(data, 2, byte((2+len(iface.HardwareAddr)+7)/8))
+	data = append(data, iface.HardwareAddr...)
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborAdvertisement,
+		Body: &icmp.RawBody{
+			Data: data,
+		},
+	}
+	// Checksum is filled in by the kernel
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	allNodes := &net.IPAddr{
+		IP:   net.IPv6linklocalallnodes,
+		Zone: iface.Name,
+	}
+	_, err = c.WriteTo(b, allNodes)
+	return err
+}
@@ -0,0 +1,179 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestRouterCache(t *testing.T) {
+	const mac = "02:00:00:00:00:02"
+	dataDir := t.TempDir()
+	cache := newRouterCache(dataDir)
+
+	ip, err := cache.Get(mac)
+	require.NoError(t, err)
+	assert.Nil(t, ip)
+
+	require.NoError(t, cache.Put(mac, net.ParseIP("fe80::1")))
+	assert.FileExists(t, filepath.Join(dataDir, "routers", mac))
+
+	// As seen by a later invocation
+	ip, err = newRouterCache(dataDir).Get(mac)
+	require.NoError(t, err)
+	assert.Equal(t, "fe80::1", ip.String())
+
+	ip, err = cache.Get("02:00:00:00:00:03")
+	require.NoError(t, err)
+	assert.Nil(t, ip, "other ENI")
+
+	old := time.Now().Add(-routerCacheTTL - time.Minute)
+	require.NoError(t, os.Chtimes(cache.path(mac), old, old))
+	ip, err = cache.Get(mac)
+	require.NoError(t, err)
+	assert.Nil(t, ip, "expired")
+
+	require.NoError(t, os.WriteFile(cache.path(mac), []byte("bogus\n"), 0600))
+	ip, err = cache.Get(mac)
+	require.NoError(t, err)
+	assert.Nil(t, ip, "corrupt")
+}
+
+// withRouterTestNS runs f in a new netns, with veth0 and veth1 up.
+func withRouterTestNS(t *testing.T, f func(targetNS ns.NetNS)) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		for _, name := range []string{"veth0", "veth1"} {
+			la := netlink.NewLinkAttrs()
+			la.Name = name
+			require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}))
+			for _, n := range []string{name, name + "p"} {
+				link, err := netlink.LinkByName(n)
+				require.NoError(t, err)
+				require.NoError(t, netlink.LinkSetUp(link))
+			}
+		}
+		f(targetNS)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDiscoverRouter6(t *testing.T) {
+	withRouterTestNS(t, func(targetNS ns.NetNS) {
+		link, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+
+		// What the kernel would add on receiving an RA, after
+		// discoverRouter6 has subscribed.  The first one is on
+		// the wrong link.
+		addErr := make(chan error, 1)
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			addErr <- targetNS.Do(func(ns.NetNS) error {
+				_, dst, _ := net.ParseCIDR("::/0")
+				for i, r := range []struct{ link, gw string }{
+					{"veth1", "fe80::2"},
+					{"veth0", "fe80::1"},
+				} {
+					l, err := netlink.LinkByName(r.link)
+					if err != nil {
+						return err
+					}
+					route := &netlink.Route{
+						LinkIndex: l.Attrs().Index,
+						Dst:       dst,
+						Gw:        net.ParseIP(r.gw),
+						Priority:  1024 + i,
+					}
+					if err := netlink.RouteAdd(route); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}()
+
+		gw, err := discoverRouter6(context.TODO(), link, 10*time.Second, false)
+		require.NoError(t, err)
+		assert.Equal(t, "fe80::1", gw.String())
+		require.NoError(t, <-addErr)
+
+		// Already there
+		gw, err = discoverRouter6(context.TODO(), link, 10*time.Second, false)
+		require.NoError(t, err)
+		assert.Equal(t, "fe80::1", gw.String())
+	})
+}
+
+func TestCurrentRouter6(t *testing.T) {
+	withRouterTestNS(t, func(ns.NetNS) {
+		link, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+
+		gw, err := currentRouter6(link)
+		require.NoError(t, err)
+		assert.Nil(t, gw, "no RA yet")
+
+		_, dst, _ := net.ParseCIDR("::/0")
+		for i, r := range []struct{ link, gw string }{
+			{"veth1", "fe80::2"},
+			{"veth0", "fe80::3"},
+		} {
+			l, err := netlink.LinkByName(r.link)
+			require.NoError(t, err)
+			require.NoError(t, netlink.RouteAdd(&netlink.Route{
+				LinkIndex: l.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP(r.gw),
+				Priority:  1024 + i,
+			}))
+		}
+
+		gw, err = currentRouter6(link)
+		require.NoError(t, err)
+		assert.Equal(t, "fe80::3", gw.String())
+	})
+}
+
+func TestDiscoverRouter6Timeout(t *testing.T) {
+	withRouterTestNS(t, func(ns.NetNS) {
+		link, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+
+		start := time.Now()
+		_, err = discoverRouter6(context.TODO(), link, 200*time.Millisecond, true)
+		assert.ErrorContains(t, err, "timed out")
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
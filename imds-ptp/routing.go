@@ -0,0 +1,424 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// RoutingConf is the policy routing layout.  These may collide with
+// other software on the node (eg: aws-vpc-cni, VPNs), so are
+// configurable.  Changing them on an existing node moves our
+// existing rules and routes: see migrateRouting.
+type RoutingConf struct {
+	// Rule priorities.  Order matters: these must be increasing.
+	PriorityHairpin     int `json:"priorityHairpin"`
+	PriorityLocalPods   int `json:"priorityLocalPods"`
+	PriorityMasq        int `json:"priorityMasq"`
+	PrioritySNAT        int `json:"prioritySNAT"`
+	PriorityOutgoingENI int `json:"priorityOutgoingENI"`
+
+	// Route table for local pods
+	TablePod int `json:"tablePod"`
+	// First per-ENI route table.  See eniRouteTable.
+	TableENIStart int `json:"tableENIStart"`
+}
+
+var defaultRoutingConf = RoutingConf{
+	PriorityHairpin:     29990,
+	PriorityLocalPods:   30000,
+	PriorityMasq:        30010,
+	PrioritySNAT:        30015,
+	PriorityOutgoingENI: 30020,
+
+	TablePod:      9,
+	TableENIStart: 10,
+}
+
+const (
+	// Device numbers are only unique within a network card, so
+	// each card gets its own range of ENI route tables.
+	routeTablesPerCard = 100
+
+	// Upper bound on network cards per instance, so ENI tables
+	// are within routeTablesPerCard*maxNetworkCards of
+	// TableENIStart.
+	maxNetworkCards = 32
+
+	routingFile     = "routing.json"
+	routingLockFile = "routing.lock"
+)
+
+// UnmarshalJSON implements json.Unmarshaler.  priorityHairpin
+// defaults to just before priorityLocalPods, since configs (and
+// routing.json) with a custom priorityLocalPods predate it.
+func (c *RoutingConf) UnmarshalJSON(b []byte) error {
+	type plain RoutingConf
+	c.PriorityHairpin = 0
+	if err := json.Unmarshal(b, (*plain)(c)); err != nil {
+		return err
+	}
+	if c.PriorityHairpin == 0 {
+		c.PriorityHairpin = c.PriorityLocalPods - 10
+	}
+	return nil
+}
+
+// reservedTable returns true for route tables used by the kernel.
+func reservedTable(table int) bool {
+	switch table {
+	case unix.RT_TABLE_UNSPEC, unix.RT_TABLE_COMPAT, unix.RT_TABLE_DEFAULT, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL:
+		return true
+	}
+	return false
+}
+
+// eniTableRange returns true if table could be an ENI table.
+func (c RoutingConf) eniTableRange(table int) bool {
+	return table >= c.TableENIStart && table < c.TableENIStart+routeTablesPerCard*maxNetworkCards
+}
+
+// Validate returns an error if c is unusable.
+func (c RoutingConf) Validate() error {
+	prios := []struct {
+		name string
+		prio int
+	}{
+		{"priorityHairpin", c.PriorityHairpin},
+		{"priorityLocalPods", c.PriorityLocalPods},
+		{"priorityMasq", c.PriorityMasq},
+		{"prioritySNAT", c.PrioritySNAT},
+		{"priorityOutgoingENI", c.PriorityOutgoingENI},
+	}
+	for i, p := range prios {
+		// 0 is "local", 32766 is "main"
+		if p.prio <= 0 || p.prio >= 32766 {
+			return fmt.Errorf("%s %d out of range (1-32765)", p.name, p.prio)
+		}
+		if i > 0 && p.prio <= prios[i-1].prio {
+			return fmt.Errorf("%s (%d) must be greater than %s (%d)", p.name, p.prio, prios[i-1].name, prios[i-1].prio)
+		}
+	}
+
+	if c.TablePod <= 0 || reservedTable(c.TablePod) {
+		return fmt.Errorf("tablePod %d is reserved", c.TablePod)
+	}
+	if c.TableENIStart <= 0 {
+		return fmt.Errorf("tableENIStart %d out of range", c.TableENIStart)
+	}
+	if c.eniTableRange(c.TablePod) {
+		return fmt.Errorf("tablePod %d overlaps ENI tables %d-%d", c.TablePod, c.TableENIStart, c.TableENIStart+routeTablesPerCard*maxNetworkCards-1)
+	}
+
+	return nil
+}
+
+// routingMigration moves rules and routes from one RoutingConf to
+// another.
+type routingMigration struct {
+	from, to RoutingConf
+
+	// Existing ENI tables (from rules), and their new number
+	eniTables map[int]int
+}
+
+func (m routingMigration) mapTable(table int) int {
+	if table == m.from.TablePod {
+		return m.to.TablePod
+	}
+	if t, ok := m.eniTables[table]; ok {
+		return t
+	}
+	return table
+}
+
+// mapRule returns the new version of r, if r is one of ours.
+func (m routingMigration) mapRule(r netlink.Rule) (*netlink.Rule, bool) {
+	nr := r
+	switch {
+	case r.Priority == m.from.PriorityLocalPods && r.Table == m.from.TablePod:
+		nr.Priority = m.to.PriorityLocalPods
+	case r.Priority == m.from.PriorityMasq && r.Mark == masqMark && r.Table == unix.RT_TABLE_MAIN:
+		nr.Priority = m.to.PriorityMasq
+	case r.Priority == m.from.PrioritySNAT && r.Mark == snatMark && r.Table == unix.RT_TABLE_MAIN:
+		nr.Priority = m.to.PrioritySNAT
+	case r.Priority == m.from.PriorityOutgoingENI && m.from.eniTableRange(r.Table):
+		nr.Priority = m.to.PriorityOutgoingENI
+	case r.Priority == m.from.PriorityHairpin && m.from.eniTableRange(r.Table):
+		nr.Priority = m.to.PriorityHairpin
+	default:
+		return nil, false
+	}
+	nr.Table = m.mapTable(r.Table)
+	return &nr, nr.Priority != r.Priority || nr.Table != r.Table
+}
+
+// ourLinks returns the links our routes are on: pod veths (peer in
+// another netns), host interfaces recorded for pods (eg: a chained
+// bridge), and ENIs (with the source address of one of our ENI
+// rules).  Other routes in our tables belong to someone else.
+func ourLinks(dataDir string, rc RoutingConf, rules []netlink.Rule) (map[int]bool, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	recs, err := newPodRecords(dataDir).List()
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		recorded[rec.VethName] = true
+	}
+
+	var eniIPs []net.IP
+	for _, r := range rules {
+		if r.Priority == rc.PriorityOutgoingENI && rc.eniTableRange(r.Table) && r.Src != nil {
+			eniIPs = append(eniIPs, r.Src.IP)
+		}
+	}
+
+	ret := make(map[int]bool)
+	for _, link := range links {
+		attrs := link.Attrs()
+		if _, ok := link.(*netlink.Veth); ok && attrs.NetNsID >= 0 {
+			ret[attrs.Index] = true
+			continue
+		}
+		if recorded[attrs.Name] {
+			ret[attrs.Index] = true
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses on %s: %v", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			for _, ip := range eniIPs {
+				if addr.IP.Equal(ip) {
+					ret[attrs.Index] = true
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// hasRouting returns true if any of rc's rules are present.
+func hasRouting(rc RoutingConf) (bool, error) {
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		rule := netlink.NewRule()
+		rule.Priority = rc.PriorityLocalPods
+		rule.Table = rc.TablePod
+		if ok, err := findRule(family, rule); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// moveRouting moves our rules and routes from one RoutingConf to
+// another.  New rules and routes are added before the old ones are
+// removed, so traffic keeps flowing.
+func moveRouting(dataDir string, from, to RoutingConf) error {
+	families := []int{unix.AF_INET, unix.AF_INET6}
+
+	m := routingMigration{
+		from:      from,
+		to:        to,
+		eniTables: make(map[int]int),
+	}
+
+	rules := make(map[int][]netlink.Rule)
+	routes := make(map[int][]netlink.Route)
+	usedTables := make(map[int]bool)
+	var allRules []netlink.Rule
+	for _, family := range families {
+		rs, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("failed to list rules: %v", err)
+		}
+		rules[family] = rs
+		allRules = append(allRules, rs...)
+
+		// ENI tables are only known by the rules that use
+		// them.  Other tables in the same range might belong
+		// to someone else.
+		for _, r := range rs {
+			if r.Priority == from.PriorityOutgoingENI && from.eniTableRange(r.Table) {
+				m.eniTables[r.Table] = r.Table - from.TableENIStart + to.TableENIStart
+			}
+		}
+
+		filter := &netlink.Route{Table: unix.RT_TABLE_UNSPEC}
+		rts, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes: %v", err)
+		}
+		routes[family] = rts
+		for _, r := range rts {
+			usedTables[r.Table] = true
+		}
+	}
+
+	// Refuse to move into a table that is already in use (by us
+	// or anyone else), since we can't tell the routes apart
+	// afterwards.
+	oldTables := map[int]int{from.TablePod: to.TablePod}
+	for t, nt := range m.eniTables {
+		oldTables[t] = nt
+	}
+	for t, nt := range oldTables {
+		if nt != t && usedTables[nt] {
+			return fmt.Errorf("can't move route table %d to %d: table %d is already in use", t, nt, nt)
+		}
+	}
+
+	owned, err := ourLinks(dataDir, from, allRules)
+	if err != nil {
+		return err
+	}
+
+	var moved []netlink.Route
+	for _, family := range families {
+		for _, r := range routes[family] {
+			t := m.mapTable(r.Table)
+			if t == r.Table || !owned[r.LinkIndex] {
+				continue
+			}
+			nr := r
+			nr.Table = t
+			// Other flags (eg: linkdown) are state, and
+			// rejected by the kernel
+			nr.Flags &= unix.RTNH_F_ONLINK
+			if err := netlink.RouteReplace(&nr); err != nil {
+				return fmt.Errorf("failed to add route (%s): %v", nr, err)
+			}
+			moved = append(moved, r)
+		}
+	}
+
+	for _, family := range families {
+		for _, r := range rules[family] {
+			nr, ok := m.mapRule(r)
+			if !ok {
+				continue
+			}
+			if err := netlink.RuleAdd(nr); err != nil {
+				if !os.IsExist(err) {
+					return fmt.Errorf("failed to add rule (%s): %v", nr, err)
+				}
+			}
+			if err := netlink.RuleDel(&r); err != nil {
+				if !os.IsNotExist(err) {
+					return fmt.Errorf("failed to delete rule (%s): %v", r, err)
+				}
+			}
+		}
+	}
+
+	for i := range moved {
+		r := &moved[i]
+		if err := netlink.RouteDel(r); err != nil {
+			if !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("failed to delete route (%s): %v", r, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// lockRouting serialises migrateRouting (and resolveFirewall) across
+// concurrent plugin invocations.
+func lockRouting(dataDir string) (*os.File, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", dataDir, err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dataDir, routingLockFile), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// migrateRouting moves existing rules and routes if the RoutingConf
+// has changed since it was last applied.  Without routing.json (eg:
+// DataDir on tmpfs, after a reboot), there is only something to move
+// if our rules are there with the defaults, as used by nodes that
+// predate RoutingConf.
+func migrateRouting(dataDir string, want RoutingConf) error {
+	lock, err := lockRouting(dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	path := filepath.Join(dataDir, routingFile)
+
+	have := defaultRoutingConf
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &have); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		if have == want {
+			return nil
+		}
+	case os.IsNotExist(err):
+		if have != want {
+			found, err := hasRouting(have)
+			if err != nil {
+				return err
+			}
+			if !found {
+				have = want
+			}
+		}
+	default:
+		return err
+	}
+
+	if have != want {
+		log.Printf("Moving policy routing from %+v to %+v", have, want)
+		if err := moveRouting(dataDir, have, want); err != nil {
+			return fmt.Errorf("failed to move policy routing: %v", err)
+		}
+	}
+
+	data, err = json.Marshal(want)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
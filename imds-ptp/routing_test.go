@@ -0,0 +1,256 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRoutingConfValidate(t *testing.T) {
+	assert.NoError(t, defaultRoutingConf.Validate())
+
+	c := defaultRoutingConf
+	c.PriorityMasq = c.PriorityOutgoingENI
+	assert.Error(t, c.Validate(), "out of order")
+
+	c = defaultRoutingConf
+	c.PriorityLocalPods = 0
+	assert.Error(t, c.Validate(), "local")
+
+	c = defaultRoutingConf
+	c.PriorityHairpin = c.PriorityLocalPods
+	assert.Error(t, c.Validate(), "hairpin")
+
+	c = defaultRoutingConf
+	c.TablePod = unix.RT_TABLE_MAIN
+	assert.Error(t, c.Validate(), "main table")
+
+	c = defaultRoutingConf
+	c.TablePod = c.TableENIStart + 3
+	assert.Error(t, c.Validate(), "overlap")
+
+	_, err := loadConf([]byte(`{"firewall": "nftables", "routing": {"tablePod": 100, "tableENIStart": 200}}`))
+	assert.NoError(t, err)
+
+	_, err = loadConf([]byte(`{"firewall": "nftables", "routing": {"tablePod": 100}}`))
+	assert.Error(t, err)
+
+	// Older configs without priorityHairpin
+	netConf, err := loadConf([]byte(`{"firewall": "nftables", "routing": {"priorityLocalPods": 100, "priorityMasq": 110, "prioritySNAT": 115, "priorityOutgoingENI": 120}}`))
+	require.NoError(t, err)
+	assert.Equal(t, 90, netConf.Routing.PriorityHairpin)
+}
+
+func TestMigrateRouting(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	dataDir := t.TempDir()
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		from := defaultRoutingConf
+		to := RoutingConf{
+			PriorityHairpin:     19990,
+			PriorityLocalPods:   20000,
+			PriorityMasq:        20010,
+			PrioritySNAT:        20015,
+			PriorityOutgoingENI: 20020,
+			TablePod:            1009,
+			TableENIStart:       1010,
+		}
+
+		la := netlink.NewLinkAttrs()
+		la.Name = "eni0"
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "eni0p"}))
+		link, err := netlink.LinkByName("eni0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(link))
+		// ENI primary IP, as in the ENI rule below
+		addr, err := netlink.ParseAddr("10.0.1.7/24")
+		require.NoError(t, err)
+		require.NoError(t, netlink.AddrAdd(link, addr))
+
+		// Someone else's interface, eg: a VPN
+		la = netlink.NewLinkAttrs()
+		la.Name = "vpn0"
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "vpn0p"}))
+		vpn, err := netlink.LinkByName("vpn0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(vpn))
+
+		cidr := func(s string) *net.IPNet {
+			_, n, err := net.ParseCIDR(s)
+			require.NoError(t, err)
+			return n
+		}
+
+		// Someone else's table, in the ENI range
+		foreignTable := from.TableENIStart + 50
+
+		for _, r := range []netlink.Route{
+			{Table: from.TablePod, LinkIndex: link.Attrs().Index, Dst: cidr("10.0.0.5/32")},
+			// Someone else's route, in our pod table
+			{Table: from.TablePod, LinkIndex: vpn.Attrs().Index, Dst: cidr("10.8.0.0/24")},
+			{Table: from.TableENIStart + 1, LinkIndex: link.Attrs().Index, Dst: cidr("10.0.1.0/24")},
+			{Table: foreignTable, LinkIndex: link.Attrs().Index, Dst: cidr("10.9.0.0/24")},
+		} {
+			require.NoError(t, netlink.RouteAdd(&r))
+		}
+
+		rule := netlink.NewRule()
+		rule.Priority = from.PriorityLocalPods
+		rule.Table = from.TablePod
+		require.NoError(t, netlink.RuleAdd(rule))
+
+		rule = netlink.NewRule()
+		rule.Priority = from.PriorityOutgoingENI
+		rule.Table = from.TableENIStart + 1
+		rule.Src = cidr("10.0.1.7/32")
+		require.NoError(t, netlink.RuleAdd(rule))
+
+		rule = netlink.NewRule()
+		rule.Priority = from.PriorityHairpin
+		rule.Table = from.TableENIStart + 1
+		rule.Src = cidr("10.0.1.8/32")
+		require.NoError(t, netlink.RuleAdd(rule))
+
+		rule = netlink.NewRule()
+		rule.Priority = from.PriorityMasq
+		mask := uint32(masqMark)
+		rule.Mark = mask
+		rule.Mask = &mask
+		rule.Table = unix.RT_TABLE_MAIN
+		require.NoError(t, netlink.RuleAdd(rule))
+
+		// First run just records the (default) config
+		require.NoError(t, migrateRouting(dataDir, from))
+
+		require.NoError(t, migrateRouting(dataDir, to))
+
+		tableRoutes := func(table int) []netlink.Route {
+			routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			require.NoError(t, err)
+			return routes
+		}
+		assert.Len(t, tableRoutes(from.TablePod), 1, "foreign route left alone")
+		assert.Len(t, tableRoutes(to.TablePod), 1)
+		assert.Empty(t, tableRoutes(from.TableENIStart+1))
+		assert.Len(t, tableRoutes(to.TableENIStart+1), 1)
+		assert.Len(t, tableRoutes(foreignTable), 1, "foreign table moved")
+
+		for _, c := range []struct {
+			rule *netlink.Rule
+			want bool
+		}{
+			{&netlink.Rule{Priority: from.PriorityLocalPods, Table: from.TablePod}, false},
+			{&netlink.Rule{Priority: to.PriorityLocalPods, Table: to.TablePod}, true},
+			{&netlink.Rule{Priority: from.PriorityMasq, Table: unix.RT_TABLE_MAIN, Mark: masqMark}, false},
+			{&netlink.Rule{Priority: to.PriorityMasq, Table: unix.RT_TABLE_MAIN, Mark: masqMark}, true},
+			{&netlink.Rule{Priority: from.PriorityOutgoingENI, Table: from.TableENIStart + 1}, false},
+			{&netlink.Rule{Priority: to.PriorityOutgoingENI, Table: to.TableENIStart + 1, Src: cidr("10.0.1.7/32")}, true},
+			{&netlink.Rule{Priority: from.PriorityHairpin, Table: from.TableENIStart + 1}, false},
+			{&netlink.Rule{Priority: to.PriorityHairpin, Table: to.TableENIStart + 1, Src: cidr("10.0.1.8/32")}, true},
+		} {
+			ok, err := findRule(unix.AF_INET, c.rule)
+			require.NoError(t, err)
+			assert.Equal(t, c.want, ok, "rule priority %d table %d", c.rule.Priority, c.rule.Table)
+		}
+
+		// Idempotent
+		require.NoError(t, migrateRouting(dataDir, to))
+		assert.Len(t, tableRoutes(to.TablePod), 1)
+
+		// Refuses to clobber a table that is in use
+		clash := to
+		clash.TablePod = foreignTable
+		clash.TableENIStart = foreignTable + 1
+		assert.Error(t, migrateRouting(dataDir, clash))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// After a reboot (DataDir on tmpfs), there's no routing.json and none
+// of our rules, so anything in the default tables is someone else's.
+func TestMigrateRoutingAfterReboot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	require.NoError(t, err)
+	defer testutils.UnmountNS(targetNS)
+	defer targetNS.Close()
+
+	dataDir := t.TempDir()
+
+	err = targetNS.Do(func(ns.NetNS) error {
+		to := defaultRoutingConf
+		to.TablePod = 1009
+		to.TableENIStart = 1010
+
+		// One of our pods, as far as the link goes
+		require.NoError(t, newPodRecords(dataDir).Put("dummy", "eth0", podRecord{VethName: "veth0"}))
+		la := netlink.NewLinkAttrs()
+		la.Name = "veth0"
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "veth0p"}))
+		link, err := netlink.LinkByName("veth0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(link))
+
+		_, dst, _ := net.ParseCIDR("10.0.0.5/32")
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{Table: defaultRoutingConf.TablePod, LinkIndex: link.Attrs().Index, Dst: dst}))
+
+		require.NoError(t, migrateRouting(dataDir, to))
+
+		tableRoutes := func(table int) []netlink.Route {
+			routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			require.NoError(t, err)
+			return routes
+		}
+		assert.Len(t, tableRoutes(defaultRoutingConf.TablePod), 1, "route moved without our rules")
+		assert.FileExists(t, filepath.Join(dataDir, routingFile))
+
+		// An older version, with the defaults and our rules
+		require.NoError(t, os.Remove(filepath.Join(dataDir, routingFile)))
+		rule := netlink.NewRule()
+		rule.Priority = defaultRoutingConf.PriorityLocalPods
+		rule.Table = defaultRoutingConf.TablePod
+		require.NoError(t, netlink.RuleAdd(rule))
+
+		require.NoError(t, migrateRouting(dataDir, to))
+		assert.Empty(t, tableRoutes(defaultRoutingConf.TablePod))
+		assert.Len(t, tableRoutes(to.TablePod), 1)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
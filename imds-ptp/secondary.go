@@ -0,0 +1,85 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+// Secondary attachments (eg: Multus "net1") give a pod a second VPC
+// interface, typically on a dedicated ENI with a different subnet
+// and security groups.  The pod's default route belongs to its
+// primary network, and the kubelet's primary ENI is that network's
+// business too.
+//
+// Use imds-ipam deviceIndexStart/End (or networkCards) to allocate
+// from the dedicated ENIs, and "enis" here to make sure of it.
+
+// dropDefaultRoutes removes default routes from an IPAM result, for
+// secondary attachments.
+func dropDefaultRoutes(result *cniv1.Result) {
+	var routes []*types.Route
+	for _, r := range result.Routes {
+		if isDefaultRoute(&r.Dst) {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	result.Routes = routes
+}
+
+// eniInList returns true if eniMAC is in enis, by MAC or ENI ID.
+// The ENI ID is only looked up if needed, and returned if it was.
+func eniInList(ctx context.Context, imds metadata.TypedIMDS, enis []string, eniMAC string) (bool, string, error) {
+	for _, e := range enis {
+		if strings.EqualFold(e, eniMAC) {
+			return true, "", nil
+		}
+	}
+
+	eniID, err := imds.GetInterfaceID(ctx, eniMAC)
+	if err != nil {
+		return false, "", err
+	}
+	for _, e := range enis {
+		if e == eniID {
+			return true, eniID, nil
+		}
+	}
+	return false, eniID, nil
+}
+
+// checkEniAllowed returns an error if netConf.ENIs is set, and
+// doesn't include eniMAC (by MAC or ENI ID).
+func checkEniAllowed(ctx context.Context, imds metadata.TypedIMDS, netConf *NetConf, eniMAC string) error {
+	if len(netConf.ENIs) == 0 {
+		return nil
+	}
+
+	ok, eniID, err := eniInList(ctx, imds, netConf.ENIs, eniMAC)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("pod IP is on ENI %s (%s), which is not one of %v", eniMAC, eniID, netConf.ENIs)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+// External SNAT: pods on secondary ENIs normally egress with their
+// own private IP, which needs a NAT gateway to reach the internet.
+// With externalSNAT, pod traffic to destinations outside the VPC
+// (and ExcludeSNATCIDRs) is marked in the firewall, the mark selects
+// the main routing table (and hence the primary ENI) ahead of the
+// per-pod ENI rules, and it is then SNATed to the primary ENI IP.
+//
+// This is node-wide, so is configured along with the primary ENI.
+// IPv4 only.
+
+// externalSNATExclusions returns the destinations that should not be
+// SNATed: the VPC CIDRs plus any configured exclusions.
+func externalSNATExclusions(ctx context.Context, imds metadata.TypedIMDS, netConf *NetConf, primaryMAC string) ([]net.IPNet, error) {
+	vpcCIDRs, err := imds.GetVPCIPv4CIDRBlocks(ctx, primaryMAC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPC CIDRs: %v", err)
+	}
+
+	var ret []net.IPNet
+	add := func(n net.IPNet) {
+		ip4 := n.IP.To4()
+		if ip4 == nil || len(n.Mask) != net.IPv4len {
+			// IPv6 is never SNATed
+			return
+		}
+		ret = append(ret, net.IPNet{IP: ip4.Mask(n.Mask), Mask: n.Mask})
+	}
+	for _, n := range vpcCIDRs {
+		add(n)
+	}
+	for _, n := range netConf.ExcludeSNATCIDRs {
+		add(net.IPNet(n))
+	}
+	return ret, nil
+}
+
+func cidrStrings(nets []net.IPNet) []string {
+	ret := make([]string, len(nets))
+	for i, n := range nets {
+		ret[i] = n.String()
+	}
+	return ret
+}
+
+func snatRule(rc RoutingConf) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = rc.PrioritySNAT
+	mask := uint32(snatMark)
+	rule.Mark = mask
+	rule.Mask = &mask
+	rule.Family = unix.AF_INET
+	rule.Table = unix.RT_TABLE_MAIN
+	return rule
+}
+
+// setupExternalSNAT configures external SNAT if enabled, or removes
+// it otherwise.
+func setupExternalSNAT(fw nodeportFirewall, netConf *NetConf, primaryIfName string, primaryIP net.IP, exclude []net.IPNet) error {
+	rule := snatRule(netConf.Routing)
+
+	if !netConf.ExternalSNAT {
+		if err := fw.TeardownSNAT(); err != nil {
+			return err
+		}
+		if err := netlink.RuleDel(rule); err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete rule (%s): %v", rule, err)
+			}
+		}
+		return nil
+	}
+
+	if err := fw.SetupSNAT(primaryIfName, primaryIP, exclude); err != nil {
+		return err
+	}
+
+	if err := netlink.RuleAdd(rule); err != nil {
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to add rule (%s): %v", rule, err)
+		}
+	}
+
+	return nil
+}
+
+// checkExternalSNAT verifies setupExternalSNAT, if enabled.
+func checkExternalSNAT(fw nodeportFirewall, netConf *NetConf, primaryIfName string, primaryIP net.IP) error {
+	if !netConf.ExternalSNAT {
+		return nil
+	}
+
+	if err := fw.CheckSNAT(primaryIfName, primaryIP); err != nil {
+		return err
+	}
+
+	rule := snatRule(netConf.Routing)
+	if ok, err := findRule(unix.AF_INET, rule); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("SNAT fwmark rule (priority %d, mark %#x) missing", rule.Priority, rule.Mark)
+	}
+
+	return nil
+}
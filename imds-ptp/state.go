@@ -0,0 +1,239 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// eniConfigGeneration should be incremented whenever
+// setupHostEniIface changes what it configures, so existing nodes
+// redo the full setup after an upgrade.
+const eniConfigGeneration = 2
+
+// writeFileAtomic replaces path with data, such that readers see
+// either the old or new contents.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// eniState is everything setupHostEniIface configures for an ENI.
+// If this changes, the ENI needs to be reconfigured.
+type eniState struct {
+	IPVersion    int    `json:"ipVersion"`
+	MTU          int    `json:"mtu"`
+	PrimaryIface string `json:"primaryIface"`
+	Iface        string `json:"iface"`
+	IfIndex      int    `json:"ifIndex"`
+	Subnet       string `json:"subnet"`
+	PrimaryIP    string `json:"primaryIP"`
+	Table        int    `json:"table"`
+	Firewall     string `json:"firewall"`
+	// Rule priorities (the table is above)
+	Routing RoutingConf `json:"routing"`
+	// External SNAT exclusions, if SNAT is configured with this
+	// ENI (ie: primary ENI)
+	SNATExclude []string `json:"snatExclude,omitempty"`
+	// Extra routes in Table
+	RouteMTUs []RouteMTU `json:"routeMTUs,omitempty"`
+	// Hairpinning in use on this node (loose rp_filter)
+	Hairpin bool `json:"hairpin,omitempty"`
+}
+
+// Fingerprint returns a stable hash of s.
+func (s eniState) Fingerprint() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// eniMarker is persisted after an ENI has been successfully
+// configured.
+type eniMarker struct {
+	Generation  int    `json:"generation"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// eniMarkers records which ENIs have already been configured, so
+// the expensive parts of setupHostEniIface only run once per ENI.
+type eniMarkers struct {
+	dir string
+}
+
+func newEniMarkers(dataDir string) eniMarkers {
+	return eniMarkers{dir: filepath.Join(dataDir, "enis")}
+}
+
+func (m eniMarkers) path(mac string, ipVersion int) string {
+	return filepath.Join(m.dir, fmt.Sprintf("%s-v%d", mac, ipVersion))
+}
+
+// Configured returns true if the ENI was previously configured with
+// exactly state.
+func (m eniMarkers) Configured(mac string, state eniState) (bool, error) {
+	data, err := os.ReadFile(m.path(mac, state.IPVersion))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var marker eniMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		// Corrupt?  Just reconfigure.
+		return false, nil
+	}
+
+	return marker.Generation == eniConfigGeneration &&
+		marker.Fingerprint == state.Fingerprint(), nil
+}
+
+// Put records that the ENI has been configured with state.
+func (m eniMarkers) Put(mac string, state eniState) error {
+	data, err := json.Marshal(eniMarker{
+		Generation:  eniConfigGeneration,
+		Fingerprint: state.Fingerprint(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path(mac, state.IPVersion), data)
+}
+
+// podRecord is persisted for each pod, so DEL can still find the pod
+// IPs and host veth when there is no prevResult and the netns is
+// already gone.
+type podRecord struct {
+	IPs      []string `json:"ips"`
+	VethName string   `json:"vethName,omitempty"`
+}
+
+// podRecords stores a podRecord per container interface.
+type podRecords struct {
+	dir string
+}
+
+func newPodRecords(dataDir string) podRecords {
+	return podRecords{dir: filepath.Join(dataDir, "pods")}
+}
+
+func (p podRecords) path(containerID, ifName string) string {
+	return filepath.Join(p.dir, containerID+"-"+ifName)
+}
+
+// Get returns the record for a container interface, or nil if there
+// is none.
+func (p podRecords) Get(containerID, ifName string) (*podRecord, error) {
+	data, err := os.ReadFile(p.path(containerID, ifName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec podRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", p.path(containerID, ifName), err)
+	}
+	return &rec, nil
+}
+
+// Put records a container interface's IPs and host veth.
+func (p podRecords) Put(containerID, ifName string, rec podRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.path(containerID, ifName), data)
+}
+
+// Delete removes the record for a container interface.  Not an error
+// if already removed.
+func (p podRecords) Delete(containerID, ifName string) error {
+	if err := os.Remove(p.path(containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all the pod records.
+func (p podRecords) List() ([]podRecord, error) {
+	entries, err := os.ReadDir(p.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []podRecord
+	for _, e := range entries {
+		if e.IsDir() || strings.Contains(e.Name(), ".tmp") {
+			// Skip writeFileAtomic temporaries
+			continue
+		}
+		path := filepath.Join(p.dir, e.Name())
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			// Raced with Delete
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rec podRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		ret = append(ret, rec)
+	}
+	return ret, nil
+}
@@ -0,0 +1,140 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEniState() eniState {
+	return eniState{
+		IPVersion:    4,
+		MTU:          9001,
+		PrimaryIface: "ens5",
+		Iface:        "ens6",
+		IfIndex:      3,
+		Subnet:       "10.0.2.0/24",
+		PrimaryIP:    "10.0.2.4",
+		Table:        11,
+		Firewall:     firewallNftables,
+		Routing:      defaultRoutingConf,
+	}
+}
+
+func TestEniStateFingerprint(t *testing.T) {
+	state := testEniState()
+	assert.Equal(t, state.Fingerprint(), testEniState().Fingerprint(), "stable")
+
+	for name, change := range map[string]func(*eniState){
+		"mtu":         func(s *eniState) { s.MTU = 1500 },
+		"ifindex":     func(s *eniState) { s.IfIndex = 4 },
+		"primary ip":  func(s *eniState) { s.PrimaryIP = "10.0.2.5" },
+		"firewall":    func(s *eniState) { s.Firewall = firewallIptables },
+		"routing":     func(s *eniState) { s.Routing.PriorityMasq++ },
+		"snat":        func(s *eniState) { s.SNATExclude = []string{"10.0.0.0/16"} },
+		"route mtus":  func(s *eniState) { s.RouteMTUs = []RouteMTU{{MTU: 1500}} },
+		"hairpin":     func(s *eniState) { s.Hairpin = true },
+		"ip version":  func(s *eniState) { s.IPVersion = 6 },
+		"subnet":      func(s *eniState) { s.Subnet = "10.0.3.0/24" },
+		"route table": func(s *eniState) { s.Table = 12 },
+	} {
+		changed := testEniState()
+		change(&changed)
+		assert.NotEqual(t, state.Fingerprint(), changed.Fingerprint(), name)
+	}
+}
+
+func TestEniMarkers(t *testing.T) {
+	const mac = "02:00:00:00:00:02"
+	markers := newEniMarkers(t.TempDir())
+	state := testEniState()
+
+	ok, err := markers.Configured(mac, state)
+	require.NoError(t, err)
+	assert.False(t, ok, "no marker")
+
+	require.NoError(t, markers.Put(mac, state))
+	ok, err = markers.Configured(mac, state)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = markers.Configured("02:00:00:00:00:03", state)
+	require.NoError(t, err)
+	assert.False(t, ok, "other ENI")
+
+	v6 := state
+	v6.IPVersion = 6
+	ok, err = markers.Configured(mac, v6)
+	require.NoError(t, err)
+	assert.False(t, ok, "other IP version")
+
+	changed := state
+	changed.MTU = 1500
+	ok, err = markers.Configured(mac, changed)
+	require.NoError(t, err)
+	assert.False(t, ok, "fingerprint changed")
+
+	// From an older version
+	data, err := json.Marshal(eniMarker{
+		Generation:  eniConfigGeneration - 1,
+		Fingerprint: state.Fingerprint(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(markers.path(mac, 4), data, 0600))
+	ok, err = markers.Configured(mac, state)
+	require.NoError(t, err)
+	assert.False(t, ok, "generation changed")
+
+	require.NoError(t, os.WriteFile(markers.path(mac, 4), []byte("{"), 0600))
+	ok, err = markers.Configured(mac, state)
+	require.NoError(t, err)
+	assert.False(t, ok, "corrupt")
+}
+
+func TestPodRecords(t *testing.T) {
+	records := newPodRecords(t.TempDir())
+
+	rec, err := records.Get("abc", "eth0")
+	require.NoError(t, err)
+	assert.Nil(t, rec)
+
+	want := podRecord{IPs: []string{"10.0.2.20", "2001:db8:2::20"}, VethName: "eni0123456789a"}
+	require.NoError(t, records.Put("abc", "eth0", want))
+	rec, err = records.Get("abc", "eth0")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, want, *rec)
+
+	rec, err = records.Get("abc", "eth1")
+	require.NoError(t, err)
+	assert.Nil(t, rec, "other interface")
+
+	other := podRecord{IPs: []string{"10.0.2.21"}, VethName: "cni0"}
+	require.NoError(t, records.Put("def", "eth0", other))
+	recs, err := records.List()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []podRecord{want, other}, recs)
+
+	require.NoError(t, records.Delete("abc", "eth0"))
+	rec, err = records.Get("abc", "eth0")
+	require.NoError(t, err)
+	assert.Nil(t, rec)
+	// Already removed
+	assert.NoError(t, records.Delete("abc", "eth0"))
+}
@@ -0,0 +1,79 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+type undoStep struct {
+	step string
+	undo func() error
+}
+
+// undoList records how to revert each per-pod change made during
+// ADD, so a failure part-way through doesn't leave anything behind.
+//
+// Per-ENI changes are shared with other pods, and are deliberately
+// not recorded.
+type undoList struct {
+	steps []undoStep
+
+	// fault, if set, is called before each step and can return an
+	// error to simulate that step failing.  For testing only!
+	fault func(step string) error
+}
+
+// Do runs do, and if successful records undo to revert it later.
+// undo may be nil if the change is reverted by undoing some earlier
+// step (eg: addresses are removed along with their interface).
+func (u *undoList) Do(step string, do func() error, undo func() error) error {
+	if u.fault != nil {
+		if err := u.fault(step); err != nil {
+			return fmt.Errorf("%s: %w", step, err)
+		}
+	}
+
+	slog.Debug("step", "step", step)
+
+	if err := do(); err != nil {
+		slog.Debug("step failed", "step", step, "error", err)
+		return err
+	}
+
+	u.Add(step, undo)
+	return nil
+}
+
+// Add records undo, for a change that has already been made.
+func (u *undoList) Add(step string, undo func() error) {
+	if undo == nil {
+		return
+	}
+	u.steps = append(u.steps, undoStep{step: step, undo: undo})
+}
+
+// Rollback reverts all recorded changes, most recent first.  Errors
+// are logged, and don't prevent later steps from running.
+func (u *undoList) Rollback() {
+	for i := len(u.steps) - 1; i >= 0; i-- {
+		s := u.steps[i]
+		if err := s.undo(); err != nil {
+			log.Printf("Failed to undo %s: %v", s.step, err)
+		}
+	}
+	u.steps = nil
+}
@@ -0,0 +1,273 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/anguslees/aws-cni-plugins/internal/metadata"
+)
+
+var errInjected = errors.New("injected fault")
+
+// failAt returns an undoList fault hook that makes step fail.
+func failAt(step string) func(string) error {
+	return func(s string) error {
+		if s == step {
+			return errInjected
+		}
+		return nil
+	}
+}
+
+func TestUndoList(t *testing.T) {
+	steps := []string{"a", "b", "c", "d"}
+
+	for i, fail := range steps {
+		t.Run(fail, func(t *testing.T) {
+			done, undone := []string{}, []string{}
+			tx := &undoList{fault: failAt(fail)}
+			var err error
+			for _, s := range steps {
+				err = tx.Do(s, func() error {
+					done = append(done, s)
+					return nil
+				}, func() error {
+					undone = append(undone, s)
+					return nil
+				})
+				if err != nil {
+					break
+				}
+			}
+			assert.ErrorIs(t, err, errInjected)
+			assert.Equal(t, steps[:i], done)
+
+			tx.Rollback()
+
+			// Everything done is undone, in reverse
+			want := []string{}
+			for j := i - 1; j >= 0; j-- {
+				want = append(want, steps[j])
+			}
+			assert.Equal(t, want, undone)
+		})
+	}
+}
+
+func TestUndoListNilUndo(t *testing.T) {
+	var undone []string
+	tx := &undoList{}
+	_ = tx.Do("a", func() error { return nil }, func() error {
+		undone = append(undone, "a")
+		return nil
+	})
+	_ = tx.Do("b", func() error { return nil }, nil)
+	_ = tx.Do("c", func() error { return errors.New("c failed") }, func() error {
+		undone = append(undone, "c")
+		return nil
+	})
+	tx.Rollback()
+	assert.Equal(t, []string{"a"}, undone)
+}
+
+// Run a real ADD, failing at each step in turn, and check that
+// nothing is left behind: not just links, but rules, routes,
+// firewall state, the pod record, and the IPAM allocation.
+func TestSetupVethRollback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	const (
+		containerID = "dummy"
+		ifName      = "eth0"
+		primaryMAC  = "02:00:00:00:00:01"
+		eniMAC      = "02:00:00:00:00:02"
+	)
+	podHost := &net.IPNet{IP: net.ParseIP("10.0.2.20"), Mask: net.CIDRMask(32, 32)}
+	rc := defaultRoutingConf
+	eniTable := rc.TableENIStart + 1
+
+	origEC2Metadata := newEC2Metadata
+	newEC2Metadata = func(*NetConf) (metadata.EC2MetadataIface, error) {
+		return metadata.FakeIMDS(map[string]interface{}{
+			"mac":                     primaryMAC,
+			"network/interfaces/macs": primaryMAC + "/\n" + eniMAC + "/",
+
+			"network/interfaces/macs/" + primaryMAC + "/interface-id":           "eni-0001",
+			"network/interfaces/macs/" + primaryMAC + "/device-number":          "0",
+			"network/interfaces/macs/" + primaryMAC + "/local-ipv4s":            "10.0.1.4",
+			"network/interfaces/macs/" + primaryMAC + "/subnet-ipv4-cidr-block": "10.0.1.0/24",
+
+			"network/interfaces/macs/" + eniMAC + "/interface-id":           "eni-0002",
+			"network/interfaces/macs/" + eniMAC + "/device-number":          "1",
+			"network/interfaces/macs/" + eniMAC + "/local-ipv4s":            "10.0.2.4\n10.0.2.20",
+			"network/interfaces/macs/" + eniMAC + "/subnet-ipv4-cidr-block": "10.0.2.0/24",
+		}), nil
+	}
+	t.Cleanup(func() { newEC2Metadata = origEC2Metadata })
+
+	pluginDir, err := filepath.Abs(testPluginDir)
+	require.NoError(t, err)
+	t.Setenv("PATH", pluginDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TEST_PLUGIN_RESULT", `{
+  "cniVersion": "1.0.0",
+  "ips": [{"address": "10.0.2.20/24", "gateway": "169.254.0.1"}],
+  "routes": [{"dst": "0.0.0.0/0"}]
+}`)
+
+	// add runs ADD with tx in a new host and pod netns, and checks
+	// what's left after a failure.  It returns the IPAM plugin
+	// calls, and the ADD error.
+	add := func(t *testing.T, tx *undoList) ([]string, error) {
+		hostNS, err := testutils.NewNS()
+		require.NoError(t, err)
+		defer testutils.UnmountNS(hostNS)
+		defer hostNS.Close()
+
+		podNS, err := testutils.NewNS()
+		require.NoError(t, err)
+		defer testutils.UnmountNS(podNS)
+		defer podNS.Close()
+
+		dataDir := t.TempDir()
+		ipamLog := filepath.Join(t.TempDir(), "ipam.log")
+		t.Setenv("TEST_PLUGIN_LOG", ipamLog)
+
+		args := &skel.CmdArgs{
+			ContainerID: containerID,
+			Netns:       podNS.Path(),
+			IfName:      ifName,
+			StdinData: []byte(fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "mynet",
+  "type": "imds-ptp",
+  "firewall": "nftables",
+  "dataDir": %q,
+  "hairpinENIs": ["eni-0002"],
+  "ipam": {
+    "type": "test-plugin"
+  }
+}`, dataDir)),
+		}
+
+		var addErr error
+		err = hostNS.Do(func(ns.NetNS) error {
+			for name, mac := range map[string]string{"ens5": primaryMAC, "ens6": eniMAC} {
+				hwaddr, err := net.ParseMAC(mac)
+				require.NoError(t, err)
+				la := netlink.NewLinkAttrs()
+				la.Name = name
+				la.HardwareAddr = hwaddr
+				require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}))
+			}
+
+			before, err := netlink.LinkList()
+			require.NoError(t, err)
+
+			_, _, addErr = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAddTx(args, tx)
+			})
+			if addErr == nil {
+				return nil
+			}
+
+			after, err := netlink.LinkList()
+			require.NoError(t, err)
+			assert.Equal(t, len(before), len(after), "host links left behind")
+
+			rules, err := netlink.RuleList(unix.AF_INET)
+			require.NoError(t, err)
+			for _, rule := range rules {
+				if rule.Src != nil && rule.Src.String() == podHost.String() {
+					t.Errorf("pod rule left behind: %s", rule)
+				}
+			}
+			for _, table := range []int{rc.TablePod, eniTable} {
+				found, err := findRoute(unix.AF_INET, netlink.Route{Table: table, Dst: podHost})
+				require.NoError(t, err)
+				assert.False(t, found, "pod route left behind in table %d", table)
+			}
+
+			vethName := hostVethName("eni", containerID, ifName, 0)
+			fw, err := newNodeportFirewall(firewallNftables, 4)
+			require.NoError(t, err)
+			assert.Error(t, fw.CheckPod(vethName), "pod firewall left behind")
+			assert.Error(t, fw.CheckAntiSpoof(vethName, []net.IP{podHost.IP}), "anti-spoofing left behind")
+			return nil
+		})
+		require.NoError(t, err)
+		if addErr == nil {
+			return nil, nil
+		}
+
+		err = podNS.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName(ifName)
+			return err
+		})
+		assert.Error(t, err, "container veth left behind")
+
+		rec, err := newPodRecords(dataDir).Get(containerID, ifName)
+		require.NoError(t, err)
+		assert.Nil(t, rec, "pod record left behind")
+
+		calls, err := os.ReadFile(ipamLog)
+		if err != nil {
+			require.True(t, os.IsNotExist(err))
+		}
+		return strings.Fields(string(calls)), addErr
+	}
+
+	// Find all the steps
+	var allSteps []string
+	_, err = add(t, &undoList{fault: func(s string) error {
+		allSteps = append(allSteps, s)
+		return nil
+	}})
+	require.NoError(t, err)
+
+	// The interesting ones, at least
+	for _, step := range []string{"ipam add", "setup pod firewall", "add pod route", "add pod rule", "add pod hairpin rule", "setup anti-spoofing", "setup egress policer"} {
+		require.Contains(t, allSteps, step)
+	}
+
+	for _, fail := range allSteps {
+		t.Run(fail, func(t *testing.T) {
+			calls, err := add(t, &undoList{fault: failAt(fail)})
+			require.ErrorIs(t, err, errInjected)
+
+			// The address is released, unless IPAM never ran
+			if fail == "ipam add" {
+				assert.Empty(t, calls, "IPAM calls")
+			} else {
+				assert.Equal(t, []string{"ADD", "DEL"}, calls, "IPAM calls")
+			}
+		})
+	}
+}
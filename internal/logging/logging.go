@@ -0,0 +1,197 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package logging configures levelled, structured plugin logging.
+//
+// Without a log file, entries at the configured level go to stderr
+// (which ends up in the kubelet log), as before.  If a log file is
+// configured, entries at the configured level are written there as
+// JSON, along with the container ID and netns of the plugin
+// invocation, and stderr stays at Info.  Existing log.Printf calls
+// are Info.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// Conf is embedded in each plugin's NetConf.
+type Conf struct {
+	// "debug", "info" (default), "warn" or "error"
+	LogLevel string `json:"logLevel,omitempty"`
+	// JSON log file, rotated when it gets large.  Empty means
+	// stderr only.
+	LogFile string `json:"logFile,omitempty"`
+}
+
+// Rotation limits
+const (
+	maxLogSize    = 10 * 1024 * 1024
+	maxLogBackups = 5
+)
+
+// Level returns the configured level.
+func (c Conf) Level() (slog.Level, error) {
+	var level slog.Level
+	if c.LogLevel == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("invalid logLevel %q: %v", c.LogLevel, err)
+	}
+	return level, nil
+}
+
+// Init sets up stderr logging for plugin, before the config is
+// known.
+func Init(plugin string) {
+	slog.SetDefault(slog.New(newStderrHandler(plugin, slog.LevelInfo)))
+	// NB: slog.SetDefault redirects the log package to slog.
+}
+
+func newStderrHandler(plugin string, level slog.Level) slog.Handler {
+	return &textHandler{
+		prefix: "CNI " + plugin + ": ",
+		level:  level,
+		w:      os.Stderr, // NB: ends up in kubelet syslog
+	}
+}
+
+// Setup configures logging for one plugin invocation.  The returned
+// function closes the log file, and should be deferred.
+func Setup(plugin string, conf Conf, command string, args *skel.CmdArgs) (func(), error) {
+	level, err := conf.Level()
+	if err != nil {
+		return func() {}, err
+	}
+
+	stderrLevel := level
+	if conf.LogFile != "" {
+		stderrLevel = slog.LevelInfo
+	}
+
+	handlers := []slog.Handler{newStderrHandler(plugin, stderrLevel)}
+	closer := io.Closer(nopCloser{})
+	if conf.LogFile != "" {
+		f, err := openRotated(conf.LogFile, maxLogSize, maxLogBackups)
+		if err != nil {
+			// Still log to stderr
+			slog.Error("failed to open log file", "logFile", conf.LogFile, "error", err)
+		} else {
+			handlers = append(handlers, slog.NewJSONHandler(f, &slog.HandlerOptions{Level: level}))
+			closer = f
+		}
+	}
+
+	// Several plugins may share a log file
+	attrs := []slog.Attr{
+		slog.String("plugin", plugin),
+		slog.String("command", command),
+	}
+	if args != nil {
+		attrs = append(attrs,
+			slog.String("containerID", args.ContainerID),
+			slog.String("netns", args.Netns),
+			slog.String("ifName", args.IfName),
+		)
+	}
+	slog.SetDefault(slog.New(fanoutHandler(handlers).WithAttrs(attrs)))
+
+	return func() { closer.Close() }, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// fanoutHandler sends records to every handler that wants them.
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := make(fanoutHandler, len(f))
+	for i, h := range f {
+		ret[i] = h.WithAttrs(attrs)
+	}
+	return ret
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	ret := make(fanoutHandler, len(f))
+	for i, h := range f {
+		ret[i] = h.WithGroup(name)
+	}
+	return ret
+}
+
+// textHandler writes the message and any record attributes, in the
+// same format as the plain log package used to.  Handler
+// attributes (container ID, etc) are left out: the kubelet log
+// already has them.
+type textHandler struct {
+	prefix string
+	level  slog.Level
+	w      io.Writer
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	if r.Level != slog.LevelInfo {
+		b.WriteString(r.Level.String())
+		b.WriteString(": ")
+	}
+	b.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *textHandler) WithGroup(string) slog.Handler      { return h }
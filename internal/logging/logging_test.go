@@ -0,0 +1,124 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"debug": slog.LevelDebug,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		got, err := Conf{LogLevel: in}.Level()
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, in)
+	}
+
+	_, err := Conf{LogLevel: "chatty"}.Level()
+	assert.Error(t, err)
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	path := filepath.Join(t.TempDir(), "plugin.log")
+	args := &skel.CmdArgs{ContainerID: "abc123", Netns: "/var/run/netns/test", IfName: "eth0"}
+
+	done, err := Setup("test", Conf{LogLevel: "debug", LogFile: path}, "ADD", args)
+	require.NoError(t, err)
+	slog.Debug("step", "step", "create veth")
+	log.Printf("plain %d", 42)
+	done()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "DEBUG", entry["level"])
+	assert.Equal(t, "step", entry["msg"])
+	assert.Equal(t, "create veth", entry["step"])
+	assert.Equal(t, "abc123", entry["containerID"])
+	assert.Equal(t, "/var/run/netns/test", entry["netns"])
+	assert.Equal(t, "ADD", entry["command"])
+	assert.Equal(t, "test", entry["plugin"])
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "INFO", entry["level"])
+	assert.Equal(t, "plain 42", entry["msg"])
+
+	// Above configured level only
+	done, err = Setup("test", Conf{LogLevel: "warn", LogFile: path}, "DEL", args)
+	require.NoError(t, err)
+	slog.Info("quiet")
+	done()
+	data2, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, data2)
+}
+
+func TestOpenRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.log")
+
+	write := func(s string) {
+		f, err := openRotated(path, 10, 2)
+		require.NoError(t, err)
+		_, err = f.WriteString(s)
+		require.NoError(t, err)
+		f.Close()
+	}
+	read := func(p string) string {
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	write("aaaaaa")
+	write("bbbbbb") // 12 bytes, over the limit
+	assert.Equal(t, "aaaaaabbbbbb", read(path))
+
+	write("cccccc")
+	assert.Equal(t, "cccccc", read(path))
+	assert.Equal(t, "aaaaaabbbbbb", read(path+".1"))
+
+	write("dddddd")
+	write("eeeeee")
+	assert.Equal(t, "eeeeee", read(path))
+	assert.Equal(t, "ccccccdddddd", read(path+".1"))
+	assert.Equal(t, "aaaaaabbbbbb", read(path+".2"))
+
+	write("ffffff")
+	write("gggggg")
+	assert.Equal(t, "ccccccdddddd", read(path+".2"))
+	assert.Empty(t, read(path+".3"), "only 2 backups")
+}
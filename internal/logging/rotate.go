@@ -0,0 +1,88 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// openRotated opens path for appending, first rotating it (to
+// path.1, path.2, ...) if it is already larger than maxSize.
+//
+// Plugin invocations are short-lived, so checking once at startup
+// is enough.  Concurrent invocations are serialised with flock.
+func openRotated(path string, maxSize int64, backups int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// Someone else may have rotated it while we waited
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if cur, err := os.Stat(path); err != nil || !os.SameFile(fi, cur) {
+			f.Close()
+			continue
+		}
+
+		if fi.Size() <= maxSize {
+			// Unlock, but keep the file open
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return f, nil
+		}
+
+		// Rotate, then go around again to open the new file.
+		// Closing f releases the lock.
+		err = rotate(path, backups)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func rotate(path string, backups int) error {
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d", path, i)
+	}
+
+	if err := os.Remove(backup(backups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := backups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, backup(1))
+}
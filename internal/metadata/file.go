@@ -0,0 +1,199 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Source is embedded in each plugin's NetConf, so the main plugin
+// and imds-ipam read ENI details from the same place.
+type Source struct {
+	// If set, read ENI details from this file (written by a node
+	// agent) instead of IMDS.  See ENIFile.
+	ENIFile string `json:"eniFile,omitempty"`
+}
+
+// New returns the ENI file if configured, else a cached IMDS client
+// using awsConfig.
+func (s Source) New(awsConfig *aws.Config) (EC2MetadataIface, error) {
+	if s.ENIFile != "" {
+		return NewFileIMDS(s.ENIFile)
+	}
+
+	session, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return NewCachedIMDS(ec2metadata.New(session, awsConfig)), nil
+}
+
+// ENIFile describes the instance's ENIs, as written by a node agent
+// for hosts where IMDS isn't reachable from the CNI plugins (eg:
+// firewalled, or a hop limit of 1).
+type ENIFile struct {
+	// Optional
+	InstanceID       string `json:"instanceID,omitempty"`
+	InstanceType     string `json:"instanceType,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+
+	ENIs []ENIFileEntry `json:"enis"`
+}
+
+// ENIFileEntry describes one ENI.
+type ENIFileEntry struct {
+	MAC              string   `json:"mac"`
+	InterfaceID      string   `json:"interfaceID,omitempty"`
+	DeviceNumber     int      `json:"deviceNumber"`
+	NetworkCard      int      `json:"networkCard"`
+	SubnetID         string   `json:"subnetID,omitempty"`
+	SecurityGroupIDs []string `json:"securityGroupIDs,omitempty"`
+
+	// First is the primary address.  IPv6-only ENIs have no
+	// IPv4s.
+	IPv4s []string `json:"ipv4s,omitempty"`
+	IPv6s []string `json:"ipv6s,omitempty"`
+
+	SubnetIPv4CIDR string   `json:"subnetIPv4CIDR,omitempty"`
+	SubnetIPv6CIDR string   `json:"subnetIPv6CIDR,omitempty"`
+	VPCIPv4CIDRs   []string `json:"vpcIPv4CIDRs,omitempty"`
+	VPCIPv6CIDRs   []string `json:"vpcIPv6CIDRs,omitempty"`
+}
+
+// FileIMDS is an implementation of EC2MetadataIface backed by an
+// ENIFile, using the same paths as IMDS.
+type FileIMDS map[string]string
+
+// NewFileIMDS reads an ENIFile.
+func NewFileIMDS(path string) (FileIMDS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f ENIFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	ret, err := f.imds()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENI file %s: %v", path, err)
+	}
+	return ret, nil
+}
+
+func (f *ENIFile) imds() (FileIMDS, error) {
+	ret := FileIMDS{}
+
+	if f.InstanceID != "" {
+		ret["instance-id"] = f.InstanceID
+	}
+	if f.InstanceType != "" {
+		ret["instance-type"] = f.InstanceType
+	}
+	if f.AvailabilityZone != "" {
+		ret["placement/availability-zone"] = f.AvailabilityZone
+	}
+
+	var macs []string
+	for _, eni := range f.ENIs {
+		hw, err := net.ParseMAC(eni.MAC)
+		if err != nil {
+			return nil, err
+		}
+		mac := hw.String()
+		if _, ok := ret["network/interfaces/macs/"+mac+"/device-number"]; ok {
+			return nil, fmt.Errorf("duplicate ENI %s", mac)
+		}
+		macs = append(macs, mac+"/")
+
+		if len(eni.IPv4s) == 0 && len(eni.IPv6s) == 0 {
+			return nil, fmt.Errorf("ENI %s has no addresses", mac)
+		}
+		for _, list := range [][]string{eni.IPv4s, eni.IPv6s} {
+			for _, ip := range list {
+				if net.ParseIP(ip) == nil {
+					return nil, &net.ParseError{Type: "IP address", Text: ip}
+				}
+			}
+		}
+		for _, list := range [][]string{{eni.SubnetIPv4CIDR, eni.SubnetIPv6CIDR}, eni.VPCIPv4CIDRs, eni.VPCIPv6CIDRs} {
+			for _, cidr := range list {
+				if cidr == "" {
+					continue
+				}
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if eni.NetworkCard == 0 && eni.DeviceNumber == 0 {
+			if _, ok := ret["mac"]; ok {
+				return nil, fmt.Errorf("more than one primary ENI (network card 0, device 0)")
+			}
+			ret["mac"] = mac
+			if len(eni.IPv4s) != 0 {
+				ret["local-ipv4"] = eni.IPv4s[0]
+			}
+		}
+
+		prefix := "network/interfaces/macs/" + mac + "/"
+		set := func(key, value string) {
+			if value != "" {
+				ret[prefix+key] = value
+			}
+		}
+		set("interface-id", eni.InterfaceID)
+		set("device-number", strconv.Itoa(eni.DeviceNumber))
+		set("network-card", strconv.Itoa(eni.NetworkCard))
+		set("subnet-id", eni.SubnetID)
+		set("security-group-ids", strings.Join(eni.SecurityGroupIDs, "\n"))
+		set("local-ipv4s", strings.Join(eni.IPv4s, "\n"))
+		set("ipv6s", strings.Join(eni.IPv6s, "\n"))
+		set("subnet-ipv4-cidr-block", eni.SubnetIPv4CIDR)
+		set("subnet-ipv6-cidr-blocks", eni.SubnetIPv6CIDR)
+		set("vpc-ipv4-cidr-blocks", strings.Join(eni.VPCIPv4CIDRs, "\n"))
+		set("vpc-ipv6-cidr-blocks", strings.Join(eni.VPCIPv6CIDRs, "\n"))
+	}
+
+	if _, ok := ret["mac"]; !ok {
+		return nil, fmt.Errorf("no primary ENI (network card 0, device 0)")
+	}
+	ret["network/interfaces/macs"] = strings.Join(macs, "\n")
+
+	return ret, nil
+}
+
+// GetMetadataWithContext implements the EC2MetadataIface interface.
+func (f FileIMDS) GetMetadataWithContext(ctx context.Context, p string) (string, error) {
+	result, ok := f[strings.TrimSuffix(p, "/")]
+	if !ok {
+		// Same as IMDS, so IsNotFound works
+		notFoundErr := awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), http.StatusNotFound, "")
+		return "", fmt.Errorf("%s not in ENI file: %w", p, notFoundErr)
+	}
+	return result, nil
+}
@@ -0,0 +1,169 @@
+// Copyright Amazon.com Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeENIFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "enis.json")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func TestFileIMDS(t *testing.T) {
+	path := writeENIFile(t, `{
+  "instanceID": "i-084abd1f69f27d987",
+  "enis": [
+    {
+      "mac": "02:C5:F8:3E:6B:27",
+      "interfaceID": "eni-0a1b2c3d",
+      "deviceNumber": 1,
+      "networkCard": 0,
+      "ipv4s": ["10.0.2.10", "10.0.2.11"],
+      "subnetIPv4CIDR": "10.0.2.0/24"
+    },
+    {
+      "mac": "02:68:f3:f6:c7:ef",
+      "interfaceID": "eni-00112233",
+      "ipv4s": ["10.0.1.5"],
+      "ipv6s": ["2001:db8::5"],
+      "subnetIPv4CIDR": "10.0.1.0/24",
+      "subnetIPv6CIDR": "2001:db8::/64",
+      "vpcIPv4CIDRs": ["10.0.0.0/16", "100.64.0.0/16"]
+    }
+  ]
+}`)
+
+	f, err := NewFileIMDS(path)
+	require.NoError(t, err)
+	imds := NewTypedIMDS(f)
+	ctx := context.TODO()
+
+	id, err := imds.GetInstanceID(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "i-084abd1f69f27d987", id)
+
+	mac, err := imds.GetMAC(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "02:68:f3:f6:c7:ef", mac)
+
+	ip, err := imds.GetLocalIPv4(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, net.ParseIP("10.0.1.5"), ip)
+
+	macs, err := imds.GetMACs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"02:c5:f8:3e:6b:27", "02:68:f3:f6:c7:ef"}, macs)
+
+	dev, err := imds.GetDeviceNumber(ctx, "02:c5:f8:3e:6b:27")
+	require.NoError(t, err)
+	assert.Equal(t, 1, dev)
+
+	card, err := imds.GetNetworkCard(ctx, "02:c5:f8:3e:6b:27")
+	require.NoError(t, err)
+	assert.Equal(t, 0, card)
+
+	eniID, err := imds.GetInterfaceID(ctx, "02:c5:f8:3e:6b:27")
+	require.NoError(t, err)
+	assert.Equal(t, "eni-0a1b2c3d", eniID)
+
+	ips, err := imds.GetLocalIPv4s(ctx, "02:c5:f8:3e:6b:27")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.2.10"), net.ParseIP("10.0.2.11")}, ips)
+
+	ips, err = imds.GetIPv6s(ctx, "02:c5:f8:3e:6b:27")
+	assert.NoError(t, err, "missing is not an error")
+	assert.Empty(t, ips)
+
+	ips, err = imds.GetIPv6s(ctx, "02:68:f3:f6:c7:ef")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::5")}, ips)
+
+	cidr, err := imds.GetSubnetIPv6CIDRBlocks(ctx, "02:68:f3:f6:c7:ef")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::/64", cidr.String())
+
+	cidrs, err := imds.GetVPCIPv4CIDRBlocks(ctx, "02:68:f3:f6:c7:ef")
+	require.NoError(t, err)
+	assert.Len(t, cidrs, 2)
+
+	_, err = imds.GetSubnetID(ctx, "02:68:f3:f6:c7:ef")
+	assert.True(t, IsNotFound(err), "unset optional field")
+
+	_, err = imds.GetDeviceNumber(ctx, "02:00:00:00:00:01")
+	assert.True(t, IsNotFound(err), "unknown ENI")
+}
+
+func TestFileIMDSIPv6Only(t *testing.T) {
+	path := writeENIFile(t, `{
+  "enis": [
+    {
+      "mac": "02:00:00:00:00:01",
+      "ipv6s": ["2001:db8::5", "2001:db8::6"],
+      "subnetIPv6CIDR": "2001:db8::/64"
+    }
+  ]
+}`)
+
+	f, err := NewFileIMDS(path)
+	require.NoError(t, err)
+	imds := NewTypedIMDS(f)
+	ctx := context.TODO()
+
+	mac, err := imds.GetMAC(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:00:01", mac)
+
+	_, err = imds.GetLocalIPv4(ctx)
+	assert.True(t, IsNotFound(err))
+
+	_, err = imds.GetLocalIPv4s(ctx, mac)
+	assert.True(t, IsNotFound(err))
+
+	ips, err := imds.GetIPv6s(ctx, mac)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::5"), net.ParseIP("2001:db8::6")}, ips)
+}
+
+func TestFileIMDSInvalid(t *testing.T) {
+	_, err := NewFileIMDS(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+
+	for name, data := range map[string]string{
+		"syntax":     `{"enis": [`,
+		"no primary": `{"enis": [{"mac": "02:00:00:00:00:01", "deviceNumber": 1, "ipv4s": ["10.0.0.1"]}]}`,
+		"two primaries": `{"enis": [
+			{"mac": "02:00:00:00:00:01", "ipv4s": ["10.0.0.1"]},
+			{"mac": "02:00:00:00:00:02", "ipv4s": ["10.0.0.2"]}]}`,
+		"duplicate": `{"enis": [
+			{"mac": "02:00:00:00:00:01", "ipv4s": ["10.0.0.1"]},
+			{"mac": "02:00:00:00:00:01", "deviceNumber": 1, "ipv4s": ["10.0.0.2"]}]}`,
+		"bad mac":  `{"enis": [{"mac": "nope", "ipv4s": ["10.0.0.1"]}]}`,
+		"no addrs": `{"enis": [{"mac": "02:00:00:00:00:01"}]}`,
+		"bad ip":   `{"enis": [{"mac": "02:00:00:00:00:01", "ipv4s": ["10.0.0.300"]}]}`,
+		"bad cidr": `{"enis": [{"mac": "02:00:00:00:00:01", "ipv4s": ["10.0.0.1"], "subnetIPv4CIDR": "10.0.0.0"}]}`,
+	} {
+		_, err := NewFileIMDS(writeENIFile(t, data))
+		assert.Error(t, err, name)
+	}
+}
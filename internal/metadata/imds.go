@@ -112,12 +112,24 @@ func (imds TypedIMDS) getInt(ctx context.Context, key string) (int, error) {
 	return strconv.Atoi(data)
 }
 
-// GetDeviceNumber returns the unique device number associated with an interface.  The primary interface is 0.
+// GetDeviceNumber returns the device number associated with an interface.  The primary interface is 0.  Note device numbers are only unique within a network card.
 func (imds TypedIMDS) GetDeviceNumber(ctx context.Context, mac string) (int, error) {
 	key := fmt.Sprintf("network/interfaces/macs/%s/device-number", mac)
 	return imds.getInt(ctx, key)
 }
 
+// GetNetworkCard returns the index of the network card associated with an interface.  The primary interface is on card 0.
+func (imds TypedIMDS) GetNetworkCard(ctx context.Context, mac string) (int, error) {
+	key := fmt.Sprintf("network/interfaces/macs/%s/network-card", mac)
+	card, err := imds.getInt(ctx, key)
+	if IsNotFound(err) {
+		// Older instance types only have a single
+		// network card, and don't report this key.
+		return 0, nil
+	}
+	return card, err
+}
+
 // GetSubnetID returns the ID of the subnet in which the interface resides.
 func (imds TypedIMDS) GetSubnetID(ctx context.Context, mac string) (string, error) {
 	key := fmt.Sprintf("network/interfaces/macs/%s/subnet-id", mac)
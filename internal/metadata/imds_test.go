@@ -115,6 +115,23 @@ func TestGetDeviceNumber(t *testing.T) {
 	}
 }
 
+func TestGetNetworkCard(t *testing.T) {
+	f := TypedIMDS{FakeIMDS(map[string]interface{}{
+		"network/interfaces/macs/02:c5:f8:3e:6b:27/network-card": "1",
+	})}
+
+	n, err := f.GetNetworkCard(context.TODO(), "02:c5:f8:3e:6b:27")
+	if assert.NoError(t, err) {
+		assert.Equal(t, n, 1)
+	}
+
+	// Single-card instances don't report network-card
+	n, err = f.GetNetworkCard(context.TODO(), "00:00:de:ad:be:ef")
+	if assert.NoError(t, err) {
+		assert.Equal(t, n, 0)
+	}
+}
+
 func TestGetSubnetID(t *testing.T) {
 	f := TypedIMDS{FakeIMDS(map[string]interface{}{
 		"network/interfaces/macs/02:c5:f8:3e:6b:27/subnet-id": "subnet-0afaed81bf542db37",